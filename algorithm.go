@@ -0,0 +1,55 @@
+package patrol
+
+import "fmt"
+
+// An Algorithm is a rate limiting algorithm implemented by a Bucket.
+type Algorithm uint8
+
+const (
+	// TokenBucket refills tokens continuously at the Rate, up to its capacity.
+	// It's the default Algorithm.
+	TokenBucket Algorithm = iota
+	// SlidingWindow allows at most the Rate's capacity of tokens to be taken in any
+	// rolling window of the Rate's period. It approximates the rolling window by
+	// weighting the tokens taken in the previous fixed window by its overlap with it.
+	SlidingWindow
+	// FixedWindow allows at most the Rate's capacity of tokens to be taken in each
+	// window of the Rate's period, aligned to the Unix epoch.
+	FixedWindow
+	// GCRA is the Generic Cell Rate Algorithm, which spaces takes evenly at the Rate's
+	// interval, while allowing up to the Rate's capacity of them at once.
+	GCRA
+	// Concurrency limits the number of in-flight leases rather than a rate. Its Buckets
+	// are acquired and released instead of taken from.
+	Concurrency
+	// CalendarQuota limits the tokens taken in each calendar Period, which is set by a
+	// Quota instead of a Rate.
+	CalendarQuota
+)
+
+var algorithmNames = [...]string{
+	TokenBucket:   "token_bucket",
+	SlidingWindow: "sliding_window",
+	FixedWindow:   "fixed_window",
+	GCRA:          "gcra",
+	Concurrency:   "concurrency",
+	CalendarQuota: "quota",
+}
+
+// ParseAlgorithm returns the Algorithm with the given name.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for a, n := range algorithmNames {
+		if n == name {
+			return Algorithm(a), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown algorithm %q", name)
+}
+
+// String implements the Stringer interface.
+func (a Algorithm) String() string {
+	if int(a) < len(algorithmNames) {
+		return algorithmNames[a]
+	}
+	return fmt.Sprintf("Algorithm(%d)", a)
+}
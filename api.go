@@ -1,8 +1,19 @@
 package patrol
 
 import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"net/http/pprof"
@@ -13,18 +24,48 @@ import (
 
 // API implements the Patrol service HTTP API.
 type API struct {
-	log   *zap.Logger
-	clock func() time.Time
-	repo  Repo
+	log          *zap.Logger
+	clock        func() time.Time
+	repo         Repo
+	defaultRate  Rate
+	policies     atomic.Value // Policies
+	policyMu     sync.Mutex   // Serializes policy reloads.
+	policyFile   string
+	takes        *counterVec
+	takeDuration *histogram
 	http.Handler
 }
 
-// NewAPI returns a new Patrol API.
+// NewAPI returns a new Patrol API. Requests that don't specify a Rate nor match
+// any Policy are rejected, as with a zero Rate.
 func NewAPI(l *zap.Logger, clock func() time.Time, repo Repo) *API {
-	api := API{log: l, clock: clock, repo: repo}
+	return NewAPIWithDefaultRate(l, clock, repo, Rate{})
+}
+
+// NewAPIWithDefaultRate returns a new Patrol API which uses the given default Rate
+// for requests that don't specify one nor match any Policy.
+func NewAPIWithDefaultRate(l *zap.Logger, clock func() time.Time, repo Repo, defaultRate Rate) *API {
+	api := API{
+		log:          l,
+		clock:        clock,
+		repo:         repo,
+		defaultRate:  defaultRate,
+		takes:        newCounterVec("code"),
+		takeDuration: newHistogram(.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1),
+	}
 
 	rt := httprouter.New()
-	rt.HandlerFunc("POST", "/take/:name", api.takeBucket)
+	rt.HandlerFunc("POST", "/take/:name", api.instrument(api.takeBucket))
+	rt.HandlerFunc("POST", "/take", api.instrument(api.takeBuckets))
+	rt.HandlerFunc("POST", "/refund/:name", api.refundBucket)
+	rt.HandlerFunc("POST", "/acquire/:name", api.acquireBucket)
+	rt.HandlerFunc("DELETE", "/acquire/:name/:lease", api.releaseBucket)
+	rt.HandlerFunc("GET", "/buckets", api.listBuckets)
+	rt.HandlerFunc("GET", "/buckets/:name", api.getBucket)
+	rt.HandlerFunc("DELETE", "/buckets/:name", api.deleteBucket)
+	rt.HandlerFunc("POST", "/buckets/:name/refill", api.refillBucket)
+	rt.HandlerFunc("GET", "/metrics", api.metrics)
+	rt.HandlerFunc("POST", "/policies/reload", api.reloadPolicies)
 
 	rt.HandlerFunc("GET", "/debug/pprof/", pprof.Index)
 	rt.HandlerFunc("GET", "/debug/pprof/allocs", pprof.Index)
@@ -42,45 +83,1033 @@ func NewAPI(l *zap.Logger, clock func() time.Time, repo Repo) *API {
 	return &api
 }
 
+// instrument wraps the given take handler, counting its responses by status code
+// and observing its latency.
+func (api *API) instrument(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h(&sw, r)
+		api.takeDuration.observe(time.Since(start).Seconds())
+		api.takes.with(strconv.Itoa(sw.code)).inc()
+	}
+}
+
+// statusWriter is an http.ResponseWriter that records the response status code.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// metrics serves metrics in the Prometheus text exposition format.
+func (api *API) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	api.takes.write(w, "patrol_takes_total", "Total number of take requests by response status code.")
+	api.takeDuration.write(w, "patrol_take_duration_seconds", "Latency of take requests.")
+	if m, ok := api.repo.(metricsWriter); ok {
+		m.writeMetrics(w)
+	}
+}
+
+// errBucketNotFound is returned when a Bucket that must exist doesn't.
+var errBucketNotFound = errors.New("bucket not found")
+
+// errNoPolicyFile is returned when reloading Policies that weren't loaded from a file.
+var errNoPolicyFile = errors.New("no policy file loaded")
+
+// errLeaseNotFound is returned when releasing a lease that isn't held.
+var errLeaseNotFound = errors.New("lease not found")
+
+// errorResponse is the JSON response body of failed requests.
+type errorResponse struct {
+	Error string `json:"error"`
+	Param string `json:"param,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// A paramError is returned when a request parameter is invalid.
+type paramError struct {
+	param, value string
+	err          error
+}
+
+func (e *paramError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %v", e.param, e.value, e.err)
+}
+
 func (api *API) error(w http.ResponseWriter, code int, err error) {
+	res := errorResponse{Error: err.Error()}
+	if pe, ok := err.(*paramError); ok {
+		res.Param, res.Value = pe.param, pe.value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	w.Write([]byte(err.Error()))
+	json.NewEncoder(w).Encode(res)
 	api.log.Error("api error", zap.Error(err))
 }
 
+// SetPolicies sets the Policies which resolve the limits of take requests that
+// don't specify them, before falling back to the default Rate. It validates and
+// compiles Policies built by hand as ParsePolicies does, returning an error and
+// keeping the current Policies if they're invalid.
+func (api *API) SetPolicies(ps Policies) error {
+	ps, err := compilePolicies(ps)
+	if err != nil {
+		return err
+	}
+	api.policies.Store(ps)
+	return nil
+}
+
+// LoadPolicies loads the Policies in the given file and atomically swaps them for the
+// current ones, logging their differences. The current Policies are kept if the file is
+// invalid. ReloadPolicies loads the same file again.
+func (api *API) LoadPolicies(filename string) error {
+	api.policyMu.Lock()
+	defer api.policyMu.Unlock()
+	_, err := api.loadPolicies(filename)
+	return err
+}
+
+// ReloadPolicies loads the Policies in the file last loaded with LoadPolicies again.
+func (api *API) ReloadPolicies() error {
+	api.policyMu.Lock()
+	defer api.policyMu.Unlock()
+	_, err := api.loadPolicies(api.policyFile)
+	return err
+}
+
+// loadPolicies implements LoadPolicies, returning the differences between the old and
+// new Policies. It must be called with policyMu held.
+func (api *API) loadPolicies(filename string) ([]string, error) {
+	if filename == "" {
+		return nil, errNoPolicyFile
+	}
+
+	ps, err := LoadPolicies(filename)
+	if err != nil {
+		api.log.Error("failed to load policies", zap.String("file", filename), zap.Error(err))
+		return nil, err
+	}
+
+	old, _ := api.policies.Load().(Policies)
+	diff := diffPolicies(old, ps)
+
+	api.policies.Store(ps)
+	api.policyFile = filename
+
+	api.log.Info(
+		"loaded policies",
+		zap.String("file", filename),
+		zap.Int("policies", len(ps)),
+		zap.Strings("diff", diff),
+	)
+
+	return diff, nil
+}
+
+// reloadResponse is the JSON response body of a policy reload request.
+type reloadResponse struct {
+	Policies int      `json:"policies"`
+	Diff     []string `json:"diff"`
+}
+
+// reloadPolicies reloads the policy file, keeping all Buckets intact.
+func (api *API) reloadPolicies(w http.ResponseWriter, r *http.Request) {
+	api.policyMu.Lock()
+	diff, err := api.loadPolicies(api.policyFile)
+	api.policyMu.Unlock()
+
+	switch {
+	case err == errNoPolicyFile:
+		api.error(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		api.error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	ps, _ := api.policies.Load().(Policies)
+	res := reloadResponse{Policies: len(ps), Diff: diff}
+	if res.Diff == nil {
+		res.Diff = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// policy returns the first Policy that matches the given Bucket name, or one with
+// the default Rate if none does.
+func (api *API) policy(name string) Policy {
+	if ps, _ := api.policies.Load().(Policies); ps != nil {
+		if p, ok := ps.Match(name); ok {
+			return *p
+		}
+	}
+	return Policy{Rate: api.defaultRate}
+}
+
+// parseRate returns the Rate given in the "rate" query parameter, or the given Rate if absent,
+// with its Burst overridden by the "burst" query parameter if present.
+func parseRate(q url.Values, rate Rate) (Rate, error) {
+	if v := q.Get("rate"); v != "" {
+		var err error
+		if rate, err = ParseRate(v); err != nil {
+			return Rate{}, &paramError{param: "rate", value: v, err: err}
+		}
+	}
+
+	if v := q.Get("burst"); v != "" {
+		burst, err := strconv.Atoi(v)
+		if err == nil && burst < 1 {
+			err = errors.New("must be positive")
+		}
+
+		if err != nil {
+			return Rate{}, &paramError{param: "burst", value: v, err: err}
+		}
+
+		rate.Burst = burst
+	}
+
+	return rate, nil
+}
+
+// parseAlgorithm returns the Algorithm given in the "algo" query parameter, or the given one if absent.
+func parseAlgorithm(q url.Values, algo Algorithm) (Algorithm, error) {
+	v := q.Get("algo")
+	if v == "" {
+		return algo, nil
+	}
+
+	// Concurrency Buckets are acquired instead of taken from.
+	algo, err := ParseAlgorithm(v)
+	if err != nil || algo == Concurrency {
+		return 0, &paramError{param: "algo", value: v, err: errors.New("must be one of token_bucket, sliding_window, fixed_window, gcra or quota")}
+	}
+
+	return algo, nil
+}
+
+// parseDryRun returns the boolean given in the "dry_run" query parameter, or false if absent.
+func parseDryRun(q url.Values) (bool, error) {
+	v := q.Get("dry_run")
+	if v == "" {
+		return false, nil
+	}
+
+	dryRun, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, &paramError{param: "dry_run", value: v, err: err}
+	}
+
+	return dryRun, nil
+}
+
+// parseBucketRate returns the Rate given in the "rate" query parameter, or a zero
+// Rate if absent, meaning that the Rate is resolved per Bucket with bucketRate.
+func (api *API) parseBucketRate(q url.Values) (Rate, error) {
+	if q.Get("rate") == "" {
+		return Rate{}, nil
+	}
+	return parseRate(q, api.defaultRate)
+}
+
+// bucketRate returns the given Rate if not zero, or else the Rate of the last Take
+// of the given Bucket in this node, or else the Rate of its Policy.
+func (api *API) bucketRate(b *Bucket, r Rate) Rate {
+	if !r.IsZero() {
+		return r
+	}
+
+	if r = b.lastRate(); !r.IsZero() {
+		return r
+	}
+
+	return api.policy(b.name).Rate
+}
+
+// parseCount returns the positive count given in the "count" query parameter, or one if absent.
+func parseCount(q url.Values) (uint64, error) {
+	v := q.Get("count")
+	if v == "" {
+		return 1, nil
+	}
+
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err == nil && n == 0 {
+		err = errors.New("must be positive")
+	}
+
+	if err != nil {
+		return 0, &paramError{param: "count", value: v, err: err}
+	}
+
+	return n, nil
+}
+
 func (api *API) takeBucket(w http.ResponseWriter, r *http.Request) {
 	ps := httprouter.ParamsFromContext(r.Context())
 	name := ps.ByName("name")
 
-	if len(name) > maxBucketNameLength {
+	q := r.URL.Query()
+	policy := api.policy(name)
+	rate, err := parseRate(q, policy.Rate)
+	if err != nil {
+		api.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	count, err := parseCount(q)
+	if err != nil {
+		api.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	dryRun, err := parseDryRun(q)
+	if err != nil {
+		api.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	algo, err := parseAlgorithm(q, policy.Algorithm)
+	if err != nil {
+		api.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	quota := policy.Quota
+	if v := q.Get("quota"); v != "" {
+		if quota, err = ParseQuota(v); err != nil {
+			api.error(w, http.StatusBadRequest, &paramError{param: "quota", value: v, err: err})
+			return
+		}
+
+		if q.Get("algo") == "" {
+			algo = CalendarQuota
+		}
+	} else if q.Get("rate") != "" && q.Get("algo") == "" && algo == CalendarQuota {
+		algo = TokenBucket // A rate overrides a quota Policy.
+	} else if algo == CalendarQuota && policy.Algorithm != CalendarQuota {
+		api.error(w, http.StatusBadRequest, &paramError{param: "quota", err: errors.New("required by the quota algorithm")})
+		return
+	}
+
+	if len(name) > maxNameLength(algo) {
 		api.error(w, http.StatusBadRequest, ErrNameTooLarge)
 		return
 	}
 
-	q := r.URL.Query()
-	rate, _ := ParseRate(q.Get("rate"))
-	count, _ := strconv.ParseUint(q.Get("count"), 10, 64)
-	if count == 0 {
-		count = 1
+	now := api.clock()
+
+	var (
+		bucket    *Bucket
+		remaining uint64
+		ok        bool
+	)
+
+	if dryRun {
+		// Don't create missing Buckets, which would be replicated.
+		if bucket, ok = api.repo.LookupBucket(r.Context(), name); !ok {
+			bucket = &Bucket{name: name, created: now}
+		}
+	} else {
+		bucket, _ = api.repo.GetBucket(r.Context(), name)
 	}
 
-	bucket, _ := api.repo.GetBucket(r.Context(), name)
+	if err := bucket.Use(algo); err != nil {
+		api.error(w, http.StatusConflict, err)
+		return
+	}
+
+	switch {
+	case dryRun && algo == CalendarQuota:
+		remaining, ok = bucket.PeekQuota(now, quota, count)
+	case dryRun:
+		remaining, ok = bucket.Peek(now, rate, count)
+	case algo == CalendarQuota:
+		remaining, ok = bucket.TakeQuota(now, quota, count)
+	default:
+		remaining, ok = bucket.Take(now, rate, count)
+	}
+
+	if !dryRun {
+		api.repo.UpsertBucket(r.Context(), bucket)
+	}
 
 	code := http.StatusOK
-	remaining, ok := bucket.Take(api.clock(), rate, count)
 	if !ok {
 		code = http.StatusTooManyRequests
 	}
-	api.repo.UpsertBucket(r.Context(), bucket)
 
 	api.log.Debug(
 		"take",
 		zap.Int("code", code),
+		zap.Bool("dry_run", dryRun),
 		zap.Uint64("count", count),
 		zap.Stringer("rate", rate),
 		zap.Object("bucket", bucket),
 	)
 
+	var res takeResponse
+	h := w.Header()
+	if algo == CalendarQuota {
+		res = newQuotaResponse(now, bucket, quota, count, remaining, ok)
+		h.Set("RateLimit-Reset", seconds(quota.Reset(now).Sub(now)))
+	} else {
+		res = newTakeResponse(now, bucket, rate, count, remaining, ok)
+		if reset, ok := bucket.Delay(now, rate, uint64(rate.capacity())); ok && !rate.IsZero() {
+			h.Set("RateLimit-Reset", seconds(reset))
+		}
+	}
+
+	h.Set("RateLimit-Limit", strconv.FormatUint(res.Capacity, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatUint(remaining, 10))
+	if !ok && res.RetryAfter != nil {
+		h.Set("Retry-After", strconv.FormatFloat(math.Ceil(*res.RetryAfter), 'f', 0, 64))
+	}
+
+	if acceptsJSON(r) {
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
 	w.WriteHeader(code)
 	w.Write([]byte(strconv.FormatUint(remaining, 10)))
 }
+
+// takeResponse is the JSON response body of a take request.
+type takeResponse struct {
+	Bucket    string `json:"bucket"`
+	Allowed   bool   `json:"allowed"`
+	Remaining uint64 `json:"remaining"`
+	Capacity  uint64 `json:"capacity"`
+	Rate      string `json:"rate"`
+	// RetryAfter is the number of seconds until the take can succeed, or null if it never can.
+	RetryAfter *float64 `json:"retry_after"`
+}
+
+// newTakeResponse returns the takeResponse of a take of count tokens at the given
+// Rate from the given Bucket at time now.
+func newTakeResponse(now time.Time, b *Bucket, rate Rate, count, remaining uint64, ok bool) takeResponse {
+	res := takeResponse{
+		Bucket:     b.name,
+		Allowed:    ok,
+		Remaining:  remaining,
+		Capacity:   uint64(rate.capacity()),
+		Rate:       rate.String(),
+		RetryAfter: new(float64),
+	}
+
+	if !ok {
+		if retryAfter, retryable := b.Delay(now, rate, count); !retryable {
+			res.RetryAfter = nil
+		} else {
+			*res.RetryAfter = retryAfter.Seconds()
+		}
+	}
+
+	return res
+}
+
+// newQuotaResponse returns the takeResponse of a take of count tokens with the given
+// Quota from the given Bucket at time now, whose rate is the Quota.
+func newQuotaResponse(now time.Time, b *Bucket, quota Quota, count, remaining uint64, ok bool) takeResponse {
+	res := takeResponse{
+		Bucket:     b.name,
+		Allowed:    ok,
+		Remaining:  remaining,
+		Capacity:   quota.Limit,
+		Rate:       quota.String(),
+		RetryAfter: new(float64),
+	}
+
+	if !ok {
+		if count > quota.Limit {
+			res.RetryAfter = nil
+		} else {
+			*res.RetryAfter = quota.Reset(now).Sub(now).Seconds()
+		}
+	}
+
+	return res
+}
+
+// refundBucket gives tokens back to a Bucket across the cluster, e.g. when a request
+// fails before doing any work.
+func (api *API) refundBucket(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	name := ps.ByName("name")
+
+	q := r.URL.Query()
+	rate, err := api.parseBucketRate(q)
+	if err != nil {
+		api.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	count, err := parseCount(q)
+	if err != nil {
+		api.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	bucket, ok := api.repo.LookupBucket(r.Context(), name)
+	if !ok {
+		api.error(w, http.StatusNotFound, errBucketNotFound)
+		return
+	}
+
+	if algo := bucket.Algorithm(); algo != TokenBucket {
+		api.error(w, http.StatusBadRequest, fmt.Errorf("%s buckets can't be refunded", algo))
+		return
+	}
+
+	if rate = api.bucketRate(bucket, rate); rate.IsZero() {
+		api.error(w, http.StatusBadRequest, &paramError{
+			param: "rate",
+			err:   errors.New("required to refund a bucket with an unknown rate"),
+		})
+		return
+	}
+
+	remaining := bucket.Credit(rate, count)
+	api.repo.UpsertBucket(r.Context(), bucket)
+
+	api.log.Debug(
+		"refund",
+		zap.Uint64("count", count),
+		zap.Stringer("rate", rate),
+		zap.Object("bucket", bucket),
+	)
+
+	if acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.bucketResponse(bucket, rate))
+		return
+	}
+
+	w.Write([]byte(strconv.FormatUint(remaining, 10)))
+}
+
+// defaultLeaseTTL is the TTL of leases acquired without an explicit one.
+const defaultLeaseTTL = time.Minute
+
+// acquireResponse is the JSON response body of an acquire request.
+type acquireResponse struct {
+	Bucket   string `json:"bucket"`
+	Allowed  bool   `json:"allowed"`
+	Lease    string `json:"lease,omitempty"`
+	InFlight uint64 `json:"in_flight"`
+	Max      uint64 `json:"max"`
+	// Expires is the time at which the lease is released if it wasn't before.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// acquireBucket acquires a lease on a concurrency Bucket for an in-flight request,
+// which is released with releaseBucket.
+func (api *API) acquireBucket(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	name := ps.ByName("name")
+
+	if len(name) > maxNameLength(Concurrency) {
+		api.error(w, http.StatusBadRequest, ErrNameTooLarge)
+		return
+	}
+
+	q := r.URL.Query()
+	v := q.Get("max")
+	max, err := strconv.ParseUint(v, 10, 64)
+	if err == nil && max == 0 {
+		err = errors.New("must be positive")
+	}
+
+	if err != nil {
+		api.error(w, http.StatusBadRequest, &paramError{param: "max", value: v, err: err})
+		return
+	}
+
+	ttl := defaultLeaseTTL
+	if v := q.Get("ttl"); v != "" {
+		if ttl, err = time.ParseDuration(v); err == nil && ttl <= 0 {
+			err = errors.New("must be positive")
+		}
+
+		if err != nil {
+			api.error(w, http.StatusBadRequest, &paramError{param: "ttl", value: v, err: err})
+			return
+		}
+	}
+
+	bucket, _ := api.repo.GetBucket(r.Context(), name)
+	if err := bucket.Use(Concurrency); err != nil {
+		api.error(w, http.StatusConflict, err)
+		return
+	}
+
+	lease, inFlight, ok := bucket.Acquire(api.clock(), max, ttl)
+	api.repo.UpsertBucket(r.Context(), bucket)
+
+	code := http.StatusOK
+	if !ok {
+		code = http.StatusTooManyRequests
+	}
+
+	api.log.Debug(
+		"acquire",
+		zap.Int("code", code),
+		zap.Uint64("max", max),
+		zap.Duration("ttl", ttl),
+		zap.Object("bucket", bucket),
+	)
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.FormatUint(max, 10))
+	if inFlight < max {
+		h.Set("RateLimit-Remaining", strconv.FormatUint(max-inFlight, 10))
+	} else {
+		h.Set("RateLimit-Remaining", "0")
+	}
+
+	if acceptsJSON(r) {
+		res := acquireResponse{Bucket: name, Allowed: ok, Lease: lease.ID, InFlight: inFlight, Max: max}
+		if ok {
+			res.Expires = &lease.Expires
+		}
+
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	w.WriteHeader(code)
+	w.Write([]byte(lease.ID))
+}
+
+// releaseBucket releases a lease acquired with acquireBucket.
+func (api *API) releaseBucket(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+
+	bucket, ok := api.repo.LookupBucket(r.Context(), ps.ByName("name"))
+	if !ok {
+		api.error(w, http.StatusNotFound, errBucketNotFound)
+		return
+	}
+
+	if !bucket.Release(api.clock(), ps.ByName("lease")) {
+		api.error(w, http.StatusNotFound, errLeaseNotFound)
+		return
+	}
+
+	api.repo.UpsertBucket(r.Context(), bucket)
+	api.log.Debug("release", zap.String("lease", ps.ByName("lease")), zap.Object("bucket", bucket))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// batchTakeRequest is the JSON request body of a batch take request.
+type batchTakeRequest struct {
+	Takes []struct {
+		Bucket string `json:"bucket"`
+		Rate   string `json:"rate"`
+		Burst  int    `json:"burst"`
+		Count  uint64 `json:"count"`
+		Algo   string `json:"algo"`
+	} `json:"takes"`
+	// AllOrNothing takes no tokens unless every take is allowed.
+	AllOrNothing bool `json:"all_or_nothing"`
+}
+
+// batchTakeResponse is the JSON response body of a batch take request.
+type batchTakeResponse struct {
+	Allowed bool           `json:"allowed"`
+	Results []takeResponse `json:"results"`
+}
+
+// maxBatchTakes is the maximum number of takes in a batch take request.
+const maxBatchTakes = 100
+
+// maxBatchTakeSize is the maximum size in bytes of the body of a batch take request,
+// which fits maxBatchTakes takes of Buckets with the longest names.
+const maxBatchTakeSize = maxBatchTakes * 2 * bucketPacketSize
+
+// takeBuckets takes tokens from multiple Buckets in a single request.
+func (api *API) takeBuckets(w http.ResponseWriter, r *http.Request) {
+	var req batchTakeRequest
+	body := http.MaxBytesReader(w, r.Body, maxBatchTakeSize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		api.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch {
+	case len(req.Takes) == 0:
+		api.error(w, http.StatusBadRequest, errors.New("no takes given"))
+		return
+	case len(req.Takes) > maxBatchTakes:
+		api.error(w, http.StatusBadRequest, fmt.Errorf("more than %d takes given", maxBatchTakes))
+		return
+	}
+
+	takes := make([]BucketTake, len(req.Takes))
+	for i, t := range req.Takes {
+		q := url.Values{"rate": {t.Rate}}
+		if t.Burst != 0 {
+			q.Set("burst", strconv.Itoa(t.Burst))
+		}
+
+		if t.Count > 0 {
+			q.Set("count", strconv.FormatUint(t.Count, 10))
+		}
+
+		if t.Algo != "" {
+			q.Set("algo", t.Algo)
+		}
+
+		var algo Algorithm
+		policy := api.policy(t.Bucket)
+		rate, err := parseRate(q, policy.Rate)
+		if err == nil {
+			takes[i].N, err = parseCount(q)
+		}
+
+		if err == nil {
+			algo, err = parseAlgorithm(q, policy.Algorithm)
+		}
+
+		if err == nil && t.Rate != "" && t.Algo == "" && algo == CalendarQuota {
+			algo = TokenBucket // A rate overrides a quota Policy.
+		}
+
+		if err == nil && algo == CalendarQuota {
+			err = &paramError{param: "algo", value: t.Algo, err: errors.New("not supported in batch takes")}
+		}
+
+		if err == nil && len(t.Bucket) > maxNameLength(algo) {
+			err = ErrNameTooLarge
+		}
+
+		if err != nil {
+			if pe, ok := err.(*paramError); ok {
+				pe.param = fmt.Sprintf("takes[%d].%s", i, pe.param)
+			}
+			api.error(w, http.StatusBadRequest, err)
+			return
+		}
+
+		takes[i].Rate = rate
+		takes[i].Bucket, _ = api.repo.GetBucket(r.Context(), t.Bucket)
+
+		if err := takes[i].Bucket.Use(algo); err != nil {
+			api.error(w, http.StatusConflict, err)
+			return
+		}
+	}
+
+	now := api.clock()
+	res := batchTakeResponse{Allowed: true, Results: make([]takeResponse, len(takes))}
+	if req.AllOrNothing {
+		var err error
+		if res.Allowed, err = TakeAll(now, takes); err != nil {
+			api.error(w, http.StatusConflict, err)
+			return
+		}
+	} else {
+		for i := range takes {
+			t := &takes[i]
+			t.Remaining, t.OK = t.Bucket.Take(now, t.Rate, t.N)
+			res.Allowed = res.Allowed && t.OK
+		}
+	}
+
+	for i, t := range takes {
+		if res.Allowed || !req.AllOrNothing { // Rolled back takes left nothing to replicate.
+			api.repo.UpsertBucket(r.Context(), t.Bucket)
+		}
+		res.Results[i] = newTakeResponse(now, t.Bucket, t.Rate, t.N, t.Remaining, t.OK)
+	}
+
+	api.log.Debug("batch take", zap.Bool("allowed", res.Allowed), zap.Int("takes", len(takes)))
+
+	code := http.StatusOK
+	if !res.Allowed {
+		code = http.StatusTooManyRequests
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+// acceptsJSON returns true if the given request explicitly accepts JSON responses.
+// Wildcard media ranges don't count so that plain-text stays the default.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header["Accept"] {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			typ, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil || typ != "application/json" {
+				continue
+			}
+
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+
+			return true
+		}
+	}
+	return false
+}
+
+// seconds formats the given duration as a number of seconds, rounded up.
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// bucketResponse is the JSON response body of a bucket inspection request.
+type bucketResponse struct {
+	Name    string    `json:"name"`
+	Added   float64   `json:"added"`
+	Taken   float64   `json:"taken"`
+	Elapsed string    `json:"elapsed"`
+	Created time.Time `json:"created"`
+	Rate    string    `json:"rate"`
+	Tokens  float64   `json:"tokens"`
+	// Algorithm specific state of window based, GCRA and concurrency Buckets.
+	Algorithm string     `json:"algorithm"`
+	Window    int64      `json:"window,omitempty"`
+	Current   float64    `json:"current,omitempty"`
+	Previous  float64    `json:"previous,omitempty"`
+	TAT       *time.Time `json:"tat,omitempty"`
+	Acquired  float64    `json:"acquired,omitempty"`
+	Released  float64    `json:"released,omitempty"`
+}
+
+// getBucket responds with the state of a Bucket without modifying it or creating it.
+func (api *API) getBucket(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	name := ps.ByName("name")
+
+	rate, err := api.parseBucketRate(r.URL.Query())
+	if err != nil {
+		api.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	bucket, ok := api.repo.LookupBucket(r.Context(), name)
+	if !ok {
+		api.error(w, http.StatusNotFound, errBucketNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.bucketResponse(bucket, api.bucketRate(bucket, rate)))
+}
+
+// listResponse is the JSON response body of a bucket listing request.
+type listResponse struct {
+	Buckets []bucketResponse `json:"buckets"`
+	// Next is the cursor of the next page, absent on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// Limits of the number of Buckets listed per page.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listBuckets responds with a page of Buckets, optionally filtered by a name
+// prefix and sorted by tokens taken.
+func (api *API) listBuckets(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := ListOptions{Prefix: q.Get("prefix"), Limit: defaultListLimit}
+
+	rate, err := api.parseBucketRate(q)
+	if err != nil {
+		api.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch v := q.Get("sort"); v {
+	case "", "name":
+	case "taken":
+		opts.SortByTaken = true
+	default:
+		api.error(w, http.StatusBadRequest, &paramError{
+			param: "sort", value: v, err: errors.New(`must be "name" or "taken"`),
+		})
+		return
+	}
+
+	if v := q.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err == nil && (opts.Limit < 1 || opts.Limit > maxListLimit) {
+			err = fmt.Errorf("must be between 1 and %d", maxListLimit)
+		}
+
+		if err != nil {
+			api.error(w, http.StatusBadRequest, &paramError{param: "limit", value: v, err: err})
+			return
+		}
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		if err = decodeCursor(v, &opts); err != nil {
+			api.error(w, http.StatusBadRequest, &paramError{param: "cursor", value: v, err: err})
+			return
+		}
+	}
+
+	buckets := api.repo.ListBuckets(r.Context(), opts)
+
+	res := listResponse{Buckets: make([]bucketResponse, 0, len(buckets))}
+	for _, b := range buckets {
+		res.Buckets = append(res.Buckets, api.bucketResponse(b, api.bucketRate(b, rate)))
+	}
+
+	if len(buckets) == opts.Limit {
+		res.Next = encodeCursor(&opts, buckets[len(buckets)-1])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// encodeCursor encodes the position of the last listed Bucket as an opaque pagination
+// cursor: its name, preceded by its tokens taken when sorting by them.
+func encodeCursor(opts *ListOptions, b *Bucket) string {
+	key := opts.key(b)
+	var data []byte
+	if opts.SortByTaken {
+		data = make([]byte, 8, 8+len(key.name))
+		binary.BigEndian.PutUint64(data, math.Float64bits(key.taken))
+	}
+	return base64.RawURLEncoding.EncodeToString(append(data, key.name...))
+}
+
+// decodeCursor decodes a pagination cursor encoded with encodeCursor into the
+// position of the given ListOptions, which must be sorted the same way.
+func decodeCursor(cursor string, opts *ListOptions) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return err
+	}
+
+	if opts.SortByTaken {
+		if len(data) < 8 {
+			return errors.New(`not a cursor of sort "taken"`)
+		}
+		opts.AfterTaken = math.Float64frombits(binary.BigEndian.Uint64(data))
+		data = data[8:]
+	}
+
+	opts.After = string(data)
+	return nil
+}
+
+// deleteBucket resets a Bucket across the cluster and deletes it from this node.
+// TokenBuckets are refilled, and those of other Algorithms are Reset.
+func (api *API) deleteBucket(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	bucket, ok := api.repo.LookupBucket(r.Context(), ps.ByName("name"))
+	if !ok {
+		api.error(w, http.StatusNotFound, errBucketNotFound)
+		return
+	}
+
+	if bucket.Algorithm() == TokenBucket {
+		if _, ok = api.refill(w, r, bucket); !ok {
+			return
+		}
+	} else {
+		bucket.Reset()
+		api.repo.UpsertBucket(r.Context(), bucket)
+		api.log.Info("reset", zap.Object("bucket", bucket))
+	}
+
+	api.repo.DeleteBucket(r.Context(), bucket.name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refillBucket fills a Bucket up to its capacity across the cluster.
+func (api *API) refillBucket(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	bucket, ok := api.repo.LookupBucket(r.Context(), ps.ByName("name"))
+	if !ok {
+		api.error(w, http.StatusNotFound, errBucketNotFound)
+		return
+	}
+
+	rate, ok := api.refill(w, r, bucket)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.bucketResponse(bucket, rate))
+}
+
+// refill refills the given Bucket at the Rate given in the request or, if absent,
+// at the Rate of its last Take, and upserts it so that it's replicated. It returns the
+// Rate used, or writes an error response and returns false on failure.
+func (api *API) refill(w http.ResponseWriter, r *http.Request, bucket *Bucket) (Rate, bool) {
+	rate, err := api.parseBucketRate(r.URL.Query())
+	if err != nil {
+		api.error(w, http.StatusBadRequest, err)
+		return Rate{}, false
+	}
+
+	if rate = api.bucketRate(bucket, rate); rate.IsZero() {
+		api.error(w, http.StatusBadRequest, &paramError{
+			param: "rate",
+			err:   errors.New("required to refill a bucket with an unknown rate"),
+		})
+		return Rate{}, false
+	}
+
+	if algo := bucket.Algorithm(); algo != TokenBucket {
+		api.error(w, http.StatusBadRequest, fmt.Errorf("%s buckets can't be refilled", algo))
+		return Rate{}, false
+	}
+
+	bucket.Refill(rate)
+	api.repo.UpsertBucket(r.Context(), bucket)
+	api.log.Info("refill", zap.Stringer("rate", rate), zap.Object("bucket", bucket))
+
+	return rate, true
+}
+
+// bucketResponse returns the bucketResponse of the given Bucket at the given Rate.
+func (api *API) bucketResponse(b *Bucket, rate Rate) bucketResponse {
+	res := bucketResponse{Rate: rate.String(), Tokens: b.TokensAt(api.clock(), rate)}
+
+	b.mu.RLock()
+	res.Name = b.name
+	res.Added = b.added
+	res.Taken = b.taken
+	res.Elapsed = b.elapsed.String()
+	res.Created = b.created
+	res.Algorithm = b.algo.String()
+	res.Window = b.window
+	res.Current = b.curr
+	res.Previous = b.prev
+	res.Acquired = b.acquired
+	res.Released = b.released
+	if b.algo == GCRA {
+		tat := time.Unix(0, b.tat).UTC()
+		res.TAT = &tat
+	}
+	b.mu.RUnlock()
+
+	return res
+}
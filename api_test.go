@@ -2,10 +2,14 @@ package patrol
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -16,6 +20,11 @@ func TestAPI(t *testing.T) {
 	repo := NewLocalRepo(time.Now, &Bucket{
 		name:    "foo",
 		created: time.Now(),
+	}, &Bucket{
+		name:    "empty",
+		created: time.Now(),
+		added:   1,
+		taken:   1,
 	})
 
 	log, err := zap.NewDevelopment()
@@ -36,7 +45,79 @@ func TestAPI(t *testing.T) {
 			req:  request("POST", srv.URL+"/take/"+strings.Repeat("A", maxBucketNameLength+1)),
 			assert: response(
 				code(http.StatusBadRequest),
-				body([]byte(ErrNameTooLarge.Error())),
+				body([]byte(`{"error":"`+ErrNameTooLarge.Error()+`"}`+"\n")),
+			),
+		},
+		{
+			name: "bucket name too long for algorithm",
+			req:  request("POST", srv.URL+"/take/"+strings.Repeat("A", maxAlgoBucketNameLength+1)+"?rate=1:s&algo=gcra"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"`+ErrNameTooLarge.Error()+`"}`+"\n")),
+			),
+		},
+		{
+			name: "malformed rate",
+			req:  request("POST", srv.URL+"/take/malformed-rate?rate=30/1m"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid rate \"30/1m\": strconv.Atoi: parsing \"30/1m\": invalid syntax","param":"rate","value":"30/1m"}`+"\n")),
+			),
+		},
+		{
+			name: "malformed rate duration",
+			req:  request("POST", srv.URL+"/take/malformed-rate?rate=30:1y"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid rate \"30:1y\": time: unknown unit \"y\" in duration \"1y\"","param":"rate","value":"30:1y"}`+"\n")),
+			),
+		},
+		{
+			name: "negative rate",
+			req:  request("POST", srv.URL+"/take/negative-rate?rate=-1:1s"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid rate \"-1:1s\": rate \"-1:1s\" must not be negative","param":"rate","value":"-1:1s"}`+"\n")),
+			),
+		},
+		{
+			name: "zero rate",
+			req:  request("POST", srv.URL+"/take/zero-rate?rate=0:1s"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid rate \"0:1s\": rate \"0:1s\" must not be zero","param":"rate","value":"0:1s"}`+"\n")),
+			),
+		},
+		{
+			name: "malformed count",
+			req:  request("POST", srv.URL+"/take/malformed-count?rate=1:s&count=abc"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid count \"abc\": strconv.ParseUint: parsing \"abc\": invalid syntax","param":"count","value":"abc"}`+"\n")),
+			),
+		},
+		{
+			name: "negative count",
+			req:  request("POST", srv.URL+"/take/negative-count?rate=1:s&count=-1"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid count \"-1\": strconv.ParseUint: parsing \"-1\": invalid syntax","param":"count","value":"-1"}`+"\n")),
+			),
+		},
+		{
+			name: "malformed dry run",
+			req:  request("POST", srv.URL+"/take/malformed-dry-run?rate=1:s&dry_run=maybe"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid dry_run \"maybe\": strconv.ParseBool: parsing \"maybe\": invalid syntax","param":"dry_run","value":"maybe"}`+"\n")),
+			),
+		},
+		{
+			name: "zero count",
+			req:  request("POST", srv.URL+"/take/zero-count?rate=1:s&count=0"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid count \"0\": must be positive","param":"count","value":"0"}`+"\n")),
 			),
 		},
 		{
@@ -63,12 +144,212 @@ func TestAPI(t *testing.T) {
 				body([]byte("1")), // 1 remaining
 			),
 		},
+		{
+			name: "burst",
+			req:  request("POST", srv.URL+"/take/burst?rate=100:1m&burst=10"),
+			assert: response(
+				code(http.StatusOK),
+				header("RateLimit-Limit", "10"),
+				body([]byte("9")),
+			),
+		},
+		{
+			name: "malformed burst",
+			req:  request("POST", srv.URL+"/take/malformed-burst?rate=100:1m&burst=0"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid burst \"0\": must be positive","param":"burst","value":"0"}`+"\n")),
+			),
+		},
+		{
+			name: "malformed algo",
+			req:  request("POST", srv.URL+"/take/malformed-algo?rate=1:s&algo=leaky_bucket"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid algo \"leaky_bucket\": must be one of token_bucket, sliding_window, fixed_window, gcra or quota","param":"algo","value":"leaky_bucket"}`+"\n")),
+			),
+		},
+		{
+			name: "sliding window",
+			req:  request("POST", srv.URL+"/take/sliding-window?rate=10:1h&count=4&algo=sliding_window"),
+			assert: response(
+				code(http.StatusOK),
+				header("RateLimit-Limit", "10"),
+				body([]byte("6")),
+			),
+		},
+		{
+			name: "gcra",
+			req:  jsonRequest("POST", srv.URL+"/take/gcra?rate=10:1s:2&count=2&algo=gcra"),
+			assert: response(
+				code(http.StatusOK),
+				body([]byte(`{"bucket":"gcra","allowed":true,"remaining":0,"capacity":2,"rate":"10:1s:2","retry_after":0}`+"\n")),
+			),
+		},
+		{
+			name: "quota",
+			req:  jsonRequest("POST", srv.URL+"/take/quota?quota=5:day&count=2"),
+			assert: response(
+				code(http.StatusOK),
+				header("RateLimit-Limit", "5"),
+				body([]byte(`{"bucket":"quota","allowed":true,"remaining":3,"capacity":5,"rate":"5:day","retry_after":0}`+"\n")),
+			),
+		},
+		{
+			name: "quota required",
+			req:  request("POST", srv.URL+"/take/quota-required?algo=quota"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid quota \"\": required by the quota algorithm","param":"quota"}`+"\n")),
+			),
+		},
+		{
+			name: "algorithm conflict",
+			req:  request("POST", srv.URL+"/take/empty?rate=1:1h&algo=fixed_window"),
+			assert: response(
+				code(http.StatusConflict),
+				body([]byte(`{"error":"bucket \"empty\" uses the token_bucket algorithm"}`+"\n")),
+			),
+		},
 		{
 			name: "too many requests",
-			req:  request("POST", srv.URL+"/take/fail?rate=0:s&count=1"),
+			req:  request("POST", srv.URL+"/take/fail?rate=1:1h&count=2"),
 			assert: response(
 				code(http.StatusTooManyRequests),
-				body([]byte("0")),
+				body([]byte("1")),
+			),
+		},
+		{
+			name: "rate limit headers",
+			req:  request("POST", srv.URL+"/take/headers?rate=10:1m&count=4"),
+			assert: response(
+				code(http.StatusOK),
+				header("RateLimit-Limit", "10"),
+				header("RateLimit-Remaining", "6"),
+				header("RateLimit-Reset", "24"),
+				header("Retry-After", ""),
+			),
+		},
+		{
+			name: "retry after",
+			req:  request("POST", srv.URL+"/take/retry-after?rate=10:1m&count=11"),
+			assert: response(
+				code(http.StatusTooManyRequests),
+				header("RateLimit-Limit", "10"),
+				header("RateLimit-Remaining", "10"),
+				header("RateLimit-Reset", "0"),
+				header("Retry-After", ""), // Can never succeed.
+			),
+		},
+		{
+			name: "json retry after",
+			req:  jsonRequest("POST", srv.URL+"/take/empty?rate=1:1h&count=1"),
+			assert: response(
+				code(http.StatusTooManyRequests),
+				header("Retry-After", "3600"),
+				bodyContains([]byte(`{"bucket":"empty","allowed":false,"remaining":0,"capacity":1,"rate":"1:1h0m0s","retry_after":3599.`)),
+			),
+		},
+		{
+			name: "json never retry",
+			req:  jsonRequest("POST", srv.URL+"/take/json-never?rate=1:1m&count=3"),
+			assert: response(
+				code(http.StatusTooManyRequests),
+				header("Retry-After", ""),
+				body([]byte(`{"bucket":"json-never","allowed":false,"remaining":1,"capacity":1,"rate":"1:1m0s","retry_after":null}`+"\n")),
+			),
+		},
+		{
+			name: "json ok",
+			req:  jsonRequest("POST", srv.URL+"/take/json-ok?rate=2:1s"),
+			assert: response(
+				code(http.StatusOK),
+				header("Content-Type", "application/json"),
+				body([]byte(`{"bucket":"json-ok","allowed":true,"remaining":1,"capacity":2,"rate":"2:1s","retry_after":0}`+"\n")),
+			),
+		},
+		{
+			name: "json refused",
+			req: func() *http.Request {
+				req := request("POST", srv.URL+"/take/json-refused?rate=2:1s")
+				req.Header.Set("Accept", "text/plain, application/json;q=0")
+				return req
+			}(),
+			assert: response(
+				code(http.StatusOK),
+				body([]byte("1")),
+			),
+		},
+		{
+			name: "get bucket",
+			req:  request("GET", srv.URL+"/buckets/empty?rate=1:1h"),
+			assert: response(
+				code(http.StatusOK),
+				bodyContains([]byte(`{"name":"empty","added":1,"taken":1,"elapsed":"0s","created":`)),
+			),
+		},
+		{
+			name: "list buckets",
+			req:  request("GET", srv.URL+"/buckets?prefix=emp&limit=1"),
+			assert: response(
+				code(http.StatusOK),
+				bodyContains([]byte(`{"buckets":[{"name":"empty",`), []byte(`"next":"`)),
+			),
+		},
+		{
+			name: "list buckets bad sort",
+			req:  request("GET", srv.URL+"/buckets?sort=tokens"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid sort \"tokens\": must be \"name\" or \"taken\"","param":"sort","value":"tokens"}`+"\n")),
+			),
+		},
+		{
+			name: "list buckets by taken",
+			req:  request("GET", srv.URL+"/buckets?prefix=emp&limit=1&sort=taken"),
+			assert: response(
+				code(http.StatusOK),
+				bodyContains([]byte(`{"buckets":[{"name":"empty",`), []byte(`"next":"P_AAAAAAAABlbXB0eQ"}`)),
+			),
+		},
+		{
+			name: "list buckets by taken with cursor",
+			req:  request("GET", srv.URL+"/buckets?prefix=emp&sort=taken&cursor=P_AAAAAAAABlbXB0eQ"),
+			assert: response(
+				code(http.StatusOK),
+				body([]byte(`{"buckets":[]}`+"\n")),
+			),
+		},
+		{
+			name: "list buckets by taken with name cursor",
+			req:  request("GET", srv.URL+"/buckets?sort=taken&cursor=ZW1wdHk"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid cursor \"ZW1wdHk\": not a cursor of sort \"taken\"","param":"cursor","value":"ZW1wdHk"}`+"\n")),
+			),
+		},
+		{
+			name: "list buckets bad limit",
+			req:  request("GET", srv.URL+"/buckets?limit=1001"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid limit \"1001\": must be between 1 and 1000","param":"limit","value":"1001"}`+"\n")),
+			),
+		},
+		{
+			name: "get missing bucket",
+			req:  request("GET", srv.URL+"/buckets/missing"),
+			assert: response(
+				code(http.StatusNotFound),
+				body([]byte(`{"error":"bucket not found"}`+"\n")),
+			),
+		},
+		{
+			name: "metrics",
+			req:  request("GET", srv.URL+"/metrics"),
+			assert: response(
+				code(http.StatusOK),
+				bodyContains([]byte("# TYPE patrol_take_duration_seconds histogram\n")),
 			),
 		},
 	} {
@@ -86,6 +367,427 @@ func TestAPI(t *testing.T) {
 	}
 }
 
+func TestAPI_DefaultRate(t *testing.T) {
+	api := NewAPIWithDefaultRate(zap.NewNop(), time.Now, NewLocalRepo(time.Now), Rate{Freq: 2, Per: time.Second})
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	res, err := http.DefaultClient.Do(request("POST", srv.URL+"/take/default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	response(
+		code(http.StatusOK),
+		header("RateLimit-Limit", "2"),
+		body([]byte("1")),
+	)(t, res)
+}
+
+func TestAPI_Admin(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	repo := NewLocalRepo(clock, &Bucket{name: "unknown-rate", created: now})
+	srv := httptest.NewServer(NewAPI(zap.NewNop(), clock, repo))
+	defer srv.Close()
+
+	for _, step := range []struct {
+		req    *http.Request
+		assert func(testing.TB, *http.Response)
+	}{
+		{
+			req:    request("POST", srv.URL+"/take/admin?rate=2:1h&count=2&dry_run=true"),
+			assert: response(code(http.StatusOK), body([]byte("0"))),
+		},
+		{
+			req:    request("GET", srv.URL+"/buckets/admin"),
+			assert: response(code(http.StatusNotFound)), // Dry runs don't create buckets.
+		},
+		{
+			req:    request("POST", srv.URL+"/take/admin?rate=2:1h&count=2"),
+			assert: response(code(http.StatusOK), body([]byte("0"))),
+		},
+		{
+			req:    request("POST", srv.URL+"/take/admin?rate=2:1h&dry_run=1"),
+			assert: response(code(http.StatusTooManyRequests), body([]byte("0"))),
+		},
+		{
+			req:    request("POST", srv.URL+"/refund/admin"),
+			assert: response(code(http.StatusOK), body([]byte("1"))),
+		},
+		{
+			req:    request("POST", srv.URL+"/refund/admin?count=5"),
+			assert: response(code(http.StatusOK), body([]byte("2"))), // Capped at capacity.
+		},
+		{
+			req:    request("POST", srv.URL+"/take/admin?rate=2:1h&count=2"),
+			assert: response(code(http.StatusOK), body([]byte("0"))),
+		},
+		{
+			req:    request("POST", srv.URL+"/refund/missing"),
+			assert: response(code(http.StatusNotFound)),
+		},
+		{
+			req:    request("POST", srv.URL+"/take/admin?rate=2:1h"),
+			assert: response(code(http.StatusTooManyRequests)),
+		},
+		{
+			req: request("POST", srv.URL+"/buckets/admin/refill"),
+			assert: response(
+				code(http.StatusOK),
+				bodyContains([]byte(`"added":6,"taken":4,`), []byte(`"tokens":2,`)),
+			),
+		},
+		{
+			req:    request("POST", srv.URL+"/take/admin?rate=2:1h&count=2"),
+			assert: response(code(http.StatusOK), body([]byte("0"))),
+		},
+		{
+			req:    request("DELETE", srv.URL+"/buckets/admin"),
+			assert: response(code(http.StatusNoContent)),
+		},
+		{
+			req:    request("GET", srv.URL+"/buckets/admin"),
+			assert: response(code(http.StatusNotFound)),
+		},
+		{
+			req:    request("DELETE", srv.URL+"/buckets/admin"),
+			assert: response(code(http.StatusNotFound)),
+		},
+		{
+			req:    request("POST", srv.URL+"/take/window?rate=1:1h&algo=sliding_window"),
+			assert: response(code(http.StatusOK), body([]byte("0"))),
+		},
+		{
+			req:    request("DELETE", srv.URL+"/buckets/window"),
+			assert: response(code(http.StatusNoContent)),
+		},
+		{
+			req:    request("POST", srv.URL+"/take/window?rate=1:1h&algo=sliding_window"),
+			assert: response(code(http.StatusOK), body([]byte("0"))),
+		},
+		{
+			req: request("POST", srv.URL+"/refund/unknown-rate"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid rate \"\": required to refund a bucket with an unknown rate","param":"rate"}`+"\n")),
+			),
+		},
+		{
+			req: request("POST", srv.URL+"/buckets/unknown-rate/refill"),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"invalid rate \"\": required to refill a bucket with an unknown rate","param":"rate"}`+"\n")),
+			),
+		},
+		{
+			req:    request("POST", srv.URL+"/buckets/unknown-rate/refill?rate=1:1m"),
+			assert: response(code(http.StatusOK), bodyContains([]byte(`"tokens":1,`))),
+		},
+	} {
+		res, err := http.DefaultClient.Do(step.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%s %s", step.req.Method, step.req.URL)
+		step.assert(t, res)
+		res.Body.Close()
+	}
+}
+
+func TestAPI_BatchTake(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	repo := &upsertCounter{Repo: NewLocalRepo(clock)}
+	srv := httptest.NewServer(NewAPI(zap.NewNop(), clock, repo))
+	defer srv.Close()
+
+	const takes = `"takes":[{"bucket":"a","rate":"2:1h"},{"bucket":"b","rate":"1:1h","count":2}]`
+
+	for _, step := range []struct {
+		req    *http.Request
+		assert func(testing.TB, *http.Response)
+	}{
+		{
+			req: requestBody("POST", srv.URL+"/take", `{`+takes+`,"all_or_nothing":true}`),
+			assert: response(
+				code(http.StatusTooManyRequests),
+				body([]byte(`{"allowed":false,"results":[`+
+					`{"bucket":"a","allowed":true,"remaining":2,"capacity":2,"rate":"2:1h0m0s","retry_after":0},`+
+					`{"bucket":"b","allowed":false,"remaining":1,"capacity":1,"rate":"1:1h0m0s","retry_after":null}]}`+"\n")),
+				func(t testing.TB, _ *http.Response) {
+					if n := atomic.LoadInt64(&repo.upserts); n != 0 {
+						t.Errorf("have %d upserts, want none of rolled back takes", n)
+					}
+				},
+			),
+		},
+		{
+			req:    request("GET", srv.URL+"/buckets/a"),
+			assert: response(code(http.StatusOK), bodyContains([]byte(`"taken":0,`))),
+		},
+		{
+			req: requestBody("POST", srv.URL+"/take", `{`+takes+`}`),
+			assert: response(
+				code(http.StatusTooManyRequests),
+				bodyContains([]byte(`{"allowed":false,"results":[{"bucket":"a","allowed":true,"remaining":1,`)),
+			),
+		},
+		{
+			req:    requestBody("POST", srv.URL+"/take", `{"takes":[{"bucket":"a"}]}`),
+			assert: response(code(http.StatusTooManyRequests)),
+		},
+		{
+			req:    requestBody("POST", srv.URL+"/take", `{"takes":[{"bucket":"a","rate":"2:1h"},{"bucket":"c","rate":"1:1h"}]}`),
+			assert: response(code(http.StatusOK), bodyContains([]byte(`{"allowed":true,`))),
+		},
+		{
+			req: requestBody("POST", srv.URL+"/take", `{"takes":[{"bucket":"`+strings.Repeat("a", maxBatchTakeSize)+`"}]}`),
+			assert: response(
+				code(http.StatusBadRequest),
+				body([]byte(`{"error":"http: request body too large"}`+"\n")),
+			),
+		},
+		{
+			req:    requestBody("POST", srv.URL+"/take", `{"takes":[]}`),
+			assert: response(code(http.StatusBadRequest), body([]byte(`{"error":"no takes given"}`+"\n"))),
+		},
+		{
+			req: requestBody("POST", srv.URL+"/take", `{"takes":[{"bucket":"a","rate":"1/s"}]}`),
+			assert: response(
+				code(http.StatusBadRequest),
+				bodyContains([]byte(`"param":"takes[0].rate","value":"1/s"}`)),
+			),
+		},
+	} {
+		res, err := http.DefaultClient.Do(step.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%s %s", step.req.Method, step.req.URL)
+		step.assert(t, res)
+		res.Body.Close()
+	}
+}
+
+func TestAPI_Policies(t *testing.T) {
+	ps, err := ParsePolicies(strings.NewReader(`{"policies": [
+		{"prefix": "ip:", "rate": "10:1m", "algo": "gcra"},
+		{"glob": "tenant:*", "quota": "100:day"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewAPIWithDefaultRate(zap.NewNop(), time.Now, NewLocalRepo(time.Now), Rate{Freq: 1, Per: time.Second})
+	if err = api.SetPolicies(ps); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	for _, step := range []struct {
+		req    *http.Request
+		assert func(testing.TB, *http.Response)
+	}{
+		{
+			req:    jsonRequest("POST", srv.URL+"/take/ip:1.2.3.4"),
+			assert: response(code(http.StatusOK), bodyContains([]byte(`"capacity":10,"rate":"10:1m0s"`))),
+		},
+		{
+			req:    request("GET", srv.URL+"/buckets/ip:1.2.3.4"),
+			assert: response(code(http.StatusOK), bodyContains([]byte(`"algorithm":"gcra"`))),
+		},
+		{
+			req:    request("POST", srv.URL+"/take/ip:5.6.7.8?rate=2:1m&algo=token_bucket"), // Requests override policies.
+			assert: response(code(http.StatusOK), header("RateLimit-Limit", "2")),
+		},
+		{
+			req:    request("POST", srv.URL+"/take/tenant:42?count=10"),
+			assert: response(code(http.StatusOK), header("RateLimit-Limit", "100"), body([]byte("90"))),
+		},
+		{
+			req:    request("POST", srv.URL+"/take/other"), // The default rate.
+			assert: response(code(http.StatusOK), header("RateLimit-Limit", "1")),
+		},
+	} {
+		res, err := http.DefaultClient.Do(step.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%s %s", step.req.Method, step.req.URL)
+		step.assert(t, res)
+		res.Body.Close()
+	}
+}
+
+func TestAPI_ReloadPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patrol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policies.json")
+	write := func(policies string) {
+		if err := ioutil.WriteFile(file, []byte(`{"policies": [`+policies+`]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	api := NewAPI(zap.NewNop(), time.Now, NewLocalRepo(time.Now))
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL+"/policies/reload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response(code(http.StatusBadRequest), body([]byte(`{"error":"no policy file loaded"}`+"\n")))(t, res)
+	res.Body.Close()
+
+	write(`{"prefix": "ip:", "rate": "2:1h"}`)
+	if err := api.LoadPolicies(file); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		policies string
+		req      *http.Request
+		assert   func(testing.TB, *http.Response)
+	}{
+		{
+			req:    request("POST", srv.URL+"/take/ip:1.2.3.4?count=2"),
+			assert: response(code(http.StatusOK), body([]byte("0"))),
+		},
+		{
+			policies: `{"prefix": "ip:", "rate": "4:1h"}`,
+			req:      request("POST", srv.URL+"/policies/reload"),
+			assert: response(
+				code(http.StatusOK),
+				body([]byte(`{"policies":1,"diff":["~ prefix \"ip:\": token_bucket 4:1h0m0s (was token_bucket 2:1h0m0s)"]}`+"\n")),
+			),
+		},
+		{
+			req:    request("POST", srv.URL+"/take/ip:1.2.3.4"), // The bucket kept its state.
+			assert: response(code(http.StatusTooManyRequests), header("RateLimit-Limit", "4"), body([]byte("0"))),
+		},
+		{
+			policies: `{"prefix": "ip:"}`,
+			req:      request("POST", srv.URL+"/policies/reload"),
+			assert:   response(code(http.StatusInternalServerError), bodyContains([]byte(`rate is required`))),
+		},
+		{
+			req:    request("POST", srv.URL+"/take/ip:1.2.3.4"), // The last valid policies are kept.
+			assert: response(code(http.StatusTooManyRequests), header("RateLimit-Limit", "4")),
+		},
+	} {
+		if step.policies != "" {
+			write(step.policies)
+		}
+
+		res, err := http.DefaultClient.Do(step.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%s %s", step.req.Method, step.req.URL)
+		step.assert(t, res)
+		res.Body.Close()
+	}
+}
+
+func TestAPI_Leases(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	srv := httptest.NewServer(NewAPI(zap.NewNop(), clock, NewLocalRepo(clock)))
+	defer srv.Close()
+
+	var lease string
+	acquired := func(t testing.TB, r *http.Response) {
+		t.Helper()
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		} else if lease = string(data); len(lease) != 16 {
+			t.Errorf("have lease %q, want 16 hex digits", lease)
+		}
+	}
+
+	for _, step := range []struct {
+		elapsed time.Duration
+		req     func() *http.Request
+		assert  func(testing.TB, *http.Response)
+	}{
+		{
+			req:    func() *http.Request { return request("POST", srv.URL+"/acquire/tenant?max=1&ttl=1m") },
+			assert: response(code(http.StatusOK), header("RateLimit-Remaining", "0"), acquired),
+		},
+		{
+			req:    func() *http.Request { return jsonRequest("POST", srv.URL+"/acquire/tenant?max=1") },
+			assert: response(code(http.StatusTooManyRequests), body([]byte(`{"bucket":"tenant","allowed":false,"in_flight":1,"max":1}`+"\n"))),
+		},
+		{
+			req:    func() *http.Request { return request("POST", srv.URL+"/take/tenant?rate=1:1s") },
+			assert: response(code(http.StatusConflict)),
+		},
+		{
+			req:    func() *http.Request { return request("DELETE", srv.URL+"/acquire/tenant/unknown") },
+			assert: response(code(http.StatusNotFound), body([]byte(`{"error":"lease not found"}`+"\n"))),
+		},
+		{
+			req:    func() *http.Request { return request("DELETE", srv.URL+"/acquire/tenant/"+lease) },
+			assert: response(code(http.StatusNoContent)),
+		},
+		{
+			req:    func() *http.Request { return request("DELETE", srv.URL+"/acquire/tenant/"+lease) },
+			assert: response(code(http.StatusNotFound)),
+		},
+		{
+			req:    func() *http.Request { return request("POST", srv.URL+"/acquire/tenant?max=2&ttl=1m") },
+			assert: response(code(http.StatusOK), header("RateLimit-Remaining", "1"), acquired),
+		},
+		{
+			elapsed: time.Minute, // The lease expires, but only acquires release it.
+			req:     func() *http.Request { return request("GET", srv.URL+"/buckets/tenant") },
+			assert:  response(code(http.StatusOK), bodyContains([]byte(`"algorithm":"concurrency","acquired":2,"released":1}`))),
+		},
+		{
+			req:    func() *http.Request { return request("POST", srv.URL+"/acquire/tenant?max=1") },
+			assert: response(code(http.StatusOK), acquired),
+		},
+		{
+			req:    func() *http.Request { return request("POST", srv.URL+"/acquire/tenant?max=0") },
+			assert: response(code(http.StatusBadRequest), body([]byte(`{"error":"invalid max \"0\": must be positive","param":"max","value":"0"}`+"\n"))),
+		},
+		{
+			req:    func() *http.Request { return request("POST", srv.URL+"/take/tenant?algo=concurrency") },
+			assert: response(code(http.StatusBadRequest)),
+		},
+	} {
+		now = now.Add(step.elapsed)
+		req := step.req()
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%s %s", req.Method, req.URL)
+		step.assert(t, res)
+		res.Body.Close()
+	}
+}
+
+// upsertCounter is a Repo which counts the Buckets upserted into it.
+type upsertCounter struct {
+	Repo
+	upserts int64
+}
+
+func (r *upsertCounter) UpsertBucket(ctx context.Context, b *Bucket) (*Bucket, bool) {
+	atomic.AddInt64(&r.upserts, 1)
+	return r.Repo.UpsertBucket(ctx, b)
+}
+
 func response(asserts ...func(testing.TB, *http.Response)) func(testing.TB, *http.Response) {
 	return func(t testing.TB, r *http.Response) {
 		t.Helper()
@@ -115,6 +817,31 @@ func body(want []byte) func(testing.TB, *http.Response) {
 	}
 }
 
+func header(key, want string) func(testing.TB, *http.Response) {
+	return func(t testing.TB, r *http.Response) {
+		t.Helper()
+		if have := r.Header.Get(key); have != want {
+			t.Errorf("have header %s: %q, want %q", key, have, want)
+		}
+	}
+}
+
+func bodyContains(wants ...[]byte) func(testing.TB, *http.Response) {
+	return func(t testing.TB, r *http.Response) {
+		t.Helper()
+		have, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range wants {
+			if !bytes.Contains(have, want) {
+				t.Errorf("have body %q, want it to contain %q", have, want)
+			}
+		}
+	}
+}
+
 func request(method, rawurl string) *http.Request {
 	req, err := http.NewRequest(method, rawurl, nil)
 	if err != nil {
@@ -122,3 +849,17 @@ func request(method, rawurl string) *http.Request {
 	}
 	return req
 }
+
+func jsonRequest(method, rawurl string) *http.Request {
+	req := request(method, rawurl)
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+func requestBody(method, rawurl, body string) *http.Request {
+	req, err := http.NewRequest(method, rawurl, strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
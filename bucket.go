@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -18,7 +20,11 @@ import (
 // CRDT PN-Counter semantics which allow it to be merged without
 // coordination with other Buckets.
 type Bucket struct {
-	mu sync.RWMutex
+	// Local time of the last lookup or upsert in a LocalRepo, in Unix nanoseconds, used
+	// to expire Buckets whose Rate is unknown. Accessed atomically, so it comes first
+	// to be 64-bit aligned.
+	touched int64
+	mu      sync.RWMutex
 	// name of the Bucket.
 	name string
 	// added tokens.
@@ -29,11 +35,46 @@ type Bucket struct {
 	elapsed time.Duration
 	// Local created timestamp off of which all time deltas are calculated.
 	created time.Time
+	// Local Rate of the last Take, used to tell when the Bucket is full again.
+	rate Rate
+	// Local CLOCK reference bit used by bounded LocalRepos. Accessed atomically.
+	referenced uint32
+	// algo is the Algorithm the Bucket implements. The fields above are used by
+	// TokenBucket and the ones below by the other Algorithms.
+	algo Algorithm
+	// window is the number of the current window, or calendar Period, since the Unix epoch.
+	window int64
+	// curr and prev are the tokens taken in the current and previous windows.
+	curr, prev float64
+	// tat is the theoretical arrival time of GCRA, in nanoseconds since the Unix epoch.
+	tat int64
+	// acquired and released are the leases acquired and released of concurrency Buckets.
+	acquired, released float64
+	// Local leases granted by this node, allocated by the first Acquire.
+	leases *leaseSet
+	// Local Quota of the last TakeQuota.
+	quota Quota
+	// generation is incremented by Reset. Merges of Buckets of an older generation are
+	// skipped, and those of a newer one replace the Bucket's state.
+	generation uint32
 }
 
-// bucketFixedSize is the number of bytes that the fixed portion of a Bucket
+// bucketFixedSize is the number of bytes that the fixed portion of a TokenBucket
 // is marshalled to.
-const bucketFixedSize = 8 + 8 + 8 + 1 // added + taken + elapsed + len(name)
+const bucketFixedSize = 8 + 8 + 8 + 1 // state + len(name)
+
+// bucketAlgoFixedSize is the number of bytes that the fixed portion of a Bucket
+// of any other Algorithm is marshalled to.
+const bucketAlgoFixedSize = bucketFixedSize + 1 + 1 + 4 + 1 // + version + algo + generation + len(name)
+
+// bucketAlgoMarker takes the place of the name length of TokenBuckets in Buckets
+// of other Algorithms. It's larger than maxBucketNameLength, so nodes that only
+// know TokenBuckets fail to unmarshal those instead of misreading them.
+const bucketAlgoMarker = 0xff
+
+// bucketAlgoVersion is the version of the layout of Buckets of other Algorithms
+// than TokenBucket, which must be bumped on any change to it.
+const bucketAlgoVersion = 1
 
 // bucketPacketSize is the size of a UDP packet where a Bucket state update is sent.
 // This is limited to this value so that it can be sent without fragmentation over IPv4
@@ -43,25 +84,69 @@ const bucketPacketSize = 256
 // maxBucketNameLength is the maximum length of a Bucket's name that is allowed.
 const maxBucketNameLength = bucketPacketSize - bucketFixedSize
 
+// maxAlgoBucketNameLength is the maximum length of a Bucket's name that is allowed
+// with other Algorithms than TokenBucket, whose layout has a larger fixed portion.
+const maxAlgoBucketNameLength = bucketPacketSize - bucketAlgoFixedSize
+
+// maxNameLength returns the maximum length of the name of a Bucket of the given Algorithm.
+func maxNameLength(algo Algorithm) int {
+	if algo == TokenBucket {
+		return maxBucketNameLength
+	}
+	return maxAlgoBucketNameLength
+}
+
 // ErrNameTooLarge is returns by Bucket.MarshalBinary if the name of the
-// Bucket exceeds the length of 231.
-var ErrNameTooLarge = fmt.Errorf("bucket name larger than %d", maxBucketNameLength)
+// Bucket exceeds the length of 231, or of 224 for other Algorithms than TokenBucket.
+var ErrNameTooLarge = fmt.Errorf(
+	"bucket name larger than %d, or %d for algorithms other than token buckets",
+	maxBucketNameLength, maxAlgoBucketNameLength,
+)
 
 // MarshalBinary implements the encoding.BinaryMarshaler interface.
+// The first 24 bytes hold the state of the Bucket's Algorithm: added, taken and
+// elapsed for TokenBucket, window, curr and prev for window based and CalendarQuota ones, the
+// theoretical arrival time for GCRA, and acquired and released for Concurrency.
+//
+// TokenBuckets are followed by the length of the name and the name itself, as they
+// always were. Buckets of other Algorithms are followed by bucketAlgoMarker, the
+// layout version, the Algorithm, the generation, the length of the name and the
+// name itself.
 func (b *Bucket) MarshalBinary() ([]byte, error) {
 	b.mu.RLock()
 
-	if len(b.name) > maxBucketNameLength {
+	if len(b.name) > maxNameLength(b.algo) {
 		b.mu.RUnlock()
 		return nil, ErrNameTooLarge
 	}
 
-	data := make([]byte, bucketFixedSize+len(b.name))
-	binary.BigEndian.PutUint64(data, math.Float64bits(b.added))
-	binary.BigEndian.PutUint64(data[8:], math.Float64bits(b.taken))
-	binary.BigEndian.PutUint64(data[16:], uint64(b.elapsed))
-	data[24] = byte(len(b.name))
-	copy(data[25:], *(*[]byte)(unsafe.Pointer(&b.name)))
+	var data []byte
+	switch b.algo {
+	case TokenBucket:
+		data = make([]byte, bucketFixedSize+len(b.name))
+		binary.BigEndian.PutUint64(data, math.Float64bits(b.added))
+		binary.BigEndian.PutUint64(data[8:], math.Float64bits(b.taken))
+		binary.BigEndian.PutUint64(data[16:], uint64(b.elapsed))
+	default:
+		data = make([]byte, bucketAlgoFixedSize+len(b.name))
+		switch b.algo {
+		case GCRA:
+			binary.BigEndian.PutUint64(data, uint64(b.tat))
+		case Concurrency:
+			binary.BigEndian.PutUint64(data, math.Float64bits(b.acquired))
+			binary.BigEndian.PutUint64(data[8:], math.Float64bits(b.released))
+		default:
+			binary.BigEndian.PutUint64(data, uint64(b.window))
+			binary.BigEndian.PutUint64(data[8:], math.Float64bits(b.curr))
+			binary.BigEndian.PutUint64(data[16:], math.Float64bits(b.prev))
+		}
+		data[24] = bucketAlgoMarker
+		data[25] = bucketAlgoVersion
+		data[26] = byte(b.algo)
+		binary.BigEndian.PutUint32(data[27:], b.generation)
+	}
+	data[len(data)-len(b.name)-1] = byte(len(b.name))
+	copy(data[len(data)-len(b.name):], *(*[]byte)(unsafe.Pointer(&b.name)))
 	b.mu.RUnlock()
 
 	return data, nil
@@ -73,18 +158,51 @@ func (b *Bucket) UnmarshalBinary(data []byte) error {
 		return io.ErrShortBuffer
 	}
 
-	b.mu.Lock()
+	algo, name, generation := TokenBucket, data[bucketFixedSize:], uint32(0)
+	if data[24] == bucketAlgoMarker {
+		if len(data) < bucketAlgoFixedSize {
+			return io.ErrShortBuffer
+		}
 
-	b.added = math.Float64frombits(binary.BigEndian.Uint64(data))
-	b.taken = math.Float64frombits(binary.BigEndian.Uint64(data[8:]))
-	b.elapsed = time.Duration(binary.BigEndian.Uint64(data[16:]))
+		if v := data[25]; v != bucketAlgoVersion {
+			return fmt.Errorf("bucket version %d isn't supported, want %d", v, bucketAlgoVersion)
+		}
 
-	nameLen := int(byte(data[24]))
-	if len(data[25:]) < nameLen {
-		b.mu.Unlock()
+		if algo = Algorithm(data[26]); int(algo) >= len(algorithmNames) {
+			return fmt.Errorf("unknown algorithm %d", algo)
+		}
+
+		generation = binary.BigEndian.Uint32(data[27:])
+		name = data[bucketAlgoFixedSize:]
+	}
+
+	nameLen := int(data[len(data)-len(name)-1])
+	if len(name) < nameLen {
 		return io.ErrShortBuffer
 	}
-	b.name = string(data[25 : 25+nameLen])
+
+	b.mu.Lock()
+
+	b.reset()
+	b.algo, b.generation = algo, generation
+
+	switch algo {
+	case TokenBucket:
+		b.added = math.Float64frombits(binary.BigEndian.Uint64(data))
+		b.taken = math.Float64frombits(binary.BigEndian.Uint64(data[8:]))
+		b.elapsed = time.Duration(binary.BigEndian.Uint64(data[16:]))
+	case GCRA:
+		b.tat = int64(binary.BigEndian.Uint64(data))
+	case Concurrency:
+		b.acquired = math.Float64frombits(binary.BigEndian.Uint64(data))
+		b.released = math.Float64frombits(binary.BigEndian.Uint64(data[8:]))
+	default:
+		b.window = int64(binary.BigEndian.Uint64(data))
+		b.curr = math.Float64frombits(binary.BigEndian.Uint64(data[8:]))
+		b.prev = math.Float64frombits(binary.BigEndian.Uint64(data[16:]))
+	}
+
+	b.name = string(name[:nameLen])
 
 	b.mu.Unlock()
 	return nil
@@ -96,11 +214,15 @@ func (b *Bucket) UnmarshalBinary(data []byte) error {
 type Rate struct {
 	Freq int
 	Per  time.Duration
+	// Burst is the maximum number of events allowed at once, which
+	// defaults to Freq when zero.
+	Burst int
 }
 
-// ParseRate returns a new Rate parsed from the give string.
+// ParseRate returns a new Rate parsed from the give string in the
+// "freq:duration[:burst]" format (i.e. 50:1s or 50:1s:10).
 func ParseRate(v string) (r Rate, err error) {
-	ps := strings.SplitN(v, ":", 2)
+	ps := strings.SplitN(v, ":", 3)
 	switch len(ps) {
 	case 1:
 		ps = append(ps, "1s")
@@ -118,8 +240,24 @@ func ParseRate(v string) (r Rate, err error) {
 		ps[1] = "1" + ps[1]
 	}
 
-	r.Per, err = time.ParseDuration(ps[1])
-	return r, err
+	if r.Per, err = time.ParseDuration(ps[1]); err != nil {
+		return r, err
+	}
+
+	if len(ps) == 3 {
+		if r.Burst, err = strconv.Atoi(ps[2]); err != nil {
+			return r, err
+		}
+	}
+
+	switch {
+	case r.Freq < 0 || r.Per < 0 || r.Burst < 0:
+		return r, fmt.Errorf("rate %q must not be negative", v)
+	case r.IsZero():
+		return r, fmt.Errorf("rate %q must not be zero", v)
+	}
+
+	return r, nil
 }
 
 // IsZero returns true if either Freq or Per are zero valued.
@@ -142,6 +280,14 @@ func (r Rate) Tokens(d time.Duration) float64 {
 	return float64(d) / float64(interval)
 }
 
+// capacity returns the maximum number of tokens a Bucket can hold at this Rate.
+func (r Rate) capacity() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return float64(r.Freq)
+}
+
 // Interval returns the Rate's interval between events.
 func (r Rate) Interval() time.Duration {
 	return r.Per / time.Duration(r.Freq)
@@ -149,7 +295,11 @@ func (r Rate) Interval() time.Duration {
 
 // String implements the Stringer interface.
 func (r Rate) String() string {
-	return strconv.Itoa(r.Freq) + ":" + r.Per.String()
+	s := strconv.Itoa(r.Freq) + ":" + r.Per.String()
+	if r.Burst > 0 {
+		s += ":" + strconv.Itoa(r.Burst)
+	}
+	return s
 }
 
 // Tokens returns the number of tokens in the Bucket.
@@ -164,35 +314,311 @@ func (b *Bucket) Tokens() uint64 {
 // (apart from the Name and Created timestamp).
 func (b *Bucket) IsZero() bool {
 	b.mu.RLock()
-	zero := b.added == 0 && b.taken == 0 && b.elapsed == 0
+	zero := b.isZero()
 	b.mu.RUnlock()
 	return zero
 }
 
+// isZero implements IsZero. It must be called with the lock held.
+func (b *Bucket) isZero() bool {
+	return b.added == 0 && b.taken == 0 && b.elapsed == 0 &&
+		b.window == 0 && b.curr == 0 && b.prev == 0 && b.tat == 0 &&
+		b.acquired == 0 && b.released == 0 && b.generation == 0
+}
+
+// Reset clears the state of a Bucket of any Algorithm other than TokenBucket, along with
+// the leases this node granted, and increments its generation so that merging it resets
+// the Bucket on other nodes too. TokenBuckets don't replicate a generation, so resetting
+// them is a no-op, and Refill fills them up instead.
+func (b *Bucket) Reset() {
+	b.mu.Lock()
+	if b.algo != TokenBucket {
+		b.reset()
+		b.leases = nil
+		b.generation++
+	}
+	b.mu.Unlock()
+}
+
+// reset zeroes the replicated state of every Algorithm. It must be called with the
+// write lock held.
+func (b *Bucket) reset() {
+	b.added, b.taken, b.elapsed = 0, 0, 0
+	b.window, b.curr, b.prev = 0, 0, 0
+	b.tat, b.acquired, b.released = 0, 0, 0
+}
+
 // MarshalLogObject implements the zap.ObjectMarshaler interface
 func (b *Bucket) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	enc.AddString("name", b.name)
-	enc.AddFloat64("added", b.added)
-	enc.AddFloat64("taken", b.taken)
-	enc.AddDuration("elapsed", b.elapsed)
+	switch b.algo {
+	case TokenBucket:
+		enc.AddFloat64("added", b.added)
+		enc.AddFloat64("taken", b.taken)
+		enc.AddDuration("elapsed", b.elapsed)
+	case GCRA:
+		enc.AddString("algorithm", b.algo.String())
+		enc.AddTime("tat", time.Unix(0, b.tat))
+	case Concurrency:
+		enc.AddString("algorithm", b.algo.String())
+		enc.AddFloat64("acquired", b.acquired)
+		enc.AddFloat64("released", b.released)
+	default:
+		enc.AddString("algorithm", b.algo.String())
+		enc.AddInt64("window", b.window)
+		enc.AddFloat64("curr", b.curr)
+		enc.AddFloat64("prev", b.prev)
+	}
 	enc.AddTime("created", b.created)
 	return nil
 }
 
 // Take attempts to take n tokens out of the Bucket with the given filling Rate at time now.
-// It returns the number of remaing tokens and if the take was successful.
+// It returns the number of remaing tokens and if the take was successful. Concurrency and
+// CalendarQuota Buckets can't be taken from, which always fails with zero tokens remaining;
+// use Acquire and TakeQuota instead.
 func (b *Bucket) Take(now time.Time, r Rate, n uint64) (remaining uint64, ok bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	return b.take(now, r, n)
+}
+
+// Algorithm returns the Algorithm the Bucket implements.
+func (b *Bucket) Algorithm() Algorithm {
+	b.mu.RLock()
+	a := b.algo
+	b.mu.RUnlock()
+	return a
+}
+
+// Use sets the Algorithm of the Bucket. Since the state of one Algorithm can't be
+// converted to another's, it returns an error if the Bucket was already taken from
+// with a different Algorithm.
+func (b *Bucket) Use(a Algorithm) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.algo == a {
+		return nil
+	}
+
+	if !b.isZero() {
+		return fmt.Errorf("bucket %q uses the %s algorithm", b.name, b.algo)
+	}
+
+	b.algo = a
+	return nil
+}
+
+// take implements Take. It must be called with the write lock held.
+func (b *Bucket) take(now time.Time, r Rate, n uint64) (remaining uint64, ok bool) {
+	b.rate = r
+
+	switch b.algo {
+	case GCRA:
+		return b.gcraTake(now, r, n)
+	case SlidingWindow, FixedWindow:
+		return b.windowTake(now, r, n)
+	case Concurrency, CalendarQuota: // Acquired and taken with TakeQuota instead.
+		return 0, false
+	}
+
+	if b.added == 0 {
+		b.added = r.capacity()
+	}
+
+	tokens, added, elapsed := b.refill(now, r)
+
+	taken := float64(n)
+	if have := tokens + added; taken > have {
+		return uint64(have), false
+	}
 
+	b.elapsed += elapsed
+	b.added += added
+	b.taken += taken
+
+	return uint64(b.added - b.taken), true
+}
+
+// Peek returns the same results as Take would, without taking any tokens.
+func (b *Bucket) Peek(now time.Time, r Rate, n uint64) (remaining uint64, ok bool) {
+	b.mu.RLock()
+	have := b.available(now, r)
+	b.mu.RUnlock()
+
+	if taken := float64(n); taken <= have {
+		return uint64(have - taken), true
+	}
+	return uint64(have), false
+}
+
+// A BucketTake is a Take operation on a Bucket which is part of a TakeAll call.
+type BucketTake struct {
+	// Bucket to take tokens from.
+	Bucket *Bucket
+	// Rate at which the Bucket is refilled.
+	Rate Rate
+	// N is the number of tokens to take.
+	N uint64
+
+	// Remaining is the number of remaining tokens in the Bucket, set by TakeAll.
+	Remaining uint64
+	// OK is true if the Bucket had enough tokens for this take, set by TakeAll.
+	OK bool
+}
+
+// TakeAll atomically takes tokens out of multiple Buckets at time now, either succeeding
+// on all of them or leaving them all untouched. It returns true on success. The results of
+// each take are stored in the given BucketTakes. After a failure, their OK field tells which
+// takes succeeded before all of them were rolled back.
+//
+// The same Bucket may be part of multiple takes, which are applied in the given order.
+// The OK field of such a take accounts for the tokens taken by the earlier ones on the
+// same Bucket, so it may be false even if the take would have succeeded on its own.
+// Buckets are locked in a global order, so concurrent calls with overlapping Buckets
+// don't deadlock.
+//
+// Like Take, TakeAll can't take from Concurrency nor CalendarQuota Buckets. It returns an
+// error, before taking anything, if any of the Buckets uses one of those Algorithms.
+func TakeAll(now time.Time, takes []BucketTake) (bool, error) {
+	buckets := make([]*Bucket, 0, len(takes))
+	seen := make(map[*Bucket]bool, len(takes))
+	for _, t := range takes {
+		if !seen[t.Bucket] {
+			seen[t.Bucket] = true
+			buckets = append(buckets, t.Bucket)
+		}
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].name != buckets[j].name {
+			return buckets[i].name < buckets[j].name
+		}
+		return uintptr(unsafe.Pointer(buckets[i])) < uintptr(unsafe.Pointer(buckets[j]))
+	})
+
+	type state struct {
+		added, taken float64
+		elapsed      time.Duration
+		rate         Rate
+		window, tat  int64
+		curr, prev   float64
+	}
+
+	states := make([]state, len(buckets))
+	for i, b := range buckets {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		states[i] = state{b.added, b.taken, b.elapsed, b.rate, b.window, b.tat, b.curr, b.prev}
+	}
+
+	for _, b := range buckets {
+		if b.algo == Concurrency || b.algo == CalendarQuota {
+			return false, fmt.Errorf("bucket %q uses the %s algorithm, which can't be taken from", b.name, b.algo)
+		}
+	}
+
+	ok := true
+	for i := range takes {
+		t := &takes[i]
+		t.Remaining, t.OK = t.Bucket.take(now, t.Rate, t.N)
+		ok = ok && t.OK
+	}
+
+	if ok {
+		return true, nil
+	}
+
+	// Roll back all takes and report the tokens that each Bucket has left.
+	for i, b := range buckets {
+		s := &states[i]
+		b.added, b.taken, b.elapsed, b.rate = s.added, s.taken, s.elapsed, s.rate
+		b.window, b.curr, b.prev, b.tat = s.window, s.curr, s.prev, s.tat
+	}
+
+	for i := range takes {
+		t := &takes[i]
+		t.Remaining = uint64(t.Bucket.available(now, t.Rate))
+	}
+
+	return false, nil
+}
+
+// TokensAt returns the number of tokens the Bucket would have at time now with the
+// given filling Rate, without taking any.
+func (b *Bucket) TokensAt(now time.Time, r Rate) float64 {
+	b.mu.RLock()
+	have := b.available(now, r)
+	b.mu.RUnlock()
+	return have
+}
+
+// Delay returns the duration to wait from time now until n tokens can be taken out of
+// the Bucket with the given filling Rate. It returns false if n tokens can never be
+// taken because n exceeds the Bucket's capacity at that Rate. Quota Buckets ignore the
+// Rate in favor of the Quota of their last take.
+func (b *Bucket) Delay(now time.Time, r Rate, n uint64) (time.Duration, bool) {
+	b.mu.RLock()
+	switch b.algo {
+	case GCRA:
+		defer b.mu.RUnlock()
+		return b.gcraDelay(now, r, n)
+	case SlidingWindow, FixedWindow:
+		defer b.mu.RUnlock()
+		return b.windowDelay(now, r, n)
+	case CalendarQuota:
+		defer b.mu.RUnlock()
+		return b.quotaDelay(now, n)
+	case Concurrency:
+		b.mu.RUnlock()
+		return 0, false
+	}
+	tokens, added, _ := b.refill(now, r)
+	b.mu.RUnlock()
+
+	missing := float64(n) - (tokens + added)
+	switch {
+	case missing <= 0:
+		return 0, true
+	case float64(n) > r.capacity() || r.IsZero():
+		return 0, false
+	}
+
+	return time.Duration(math.Ceil(missing * float64(r.Per) / float64(r.Freq))), true
+}
+
+// available returns the number of tokens that can be taken out of the Bucket at time now
+// with the given Rate. It must be called with the lock held.
+func (b *Bucket) available(now time.Time, r Rate) float64 {
+	switch b.algo {
+	case GCRA:
+		return b.gcraAvailable(now, r)
+	case SlidingWindow, FixedWindow:
+		return b.windowAvailable(now, r)
+	case CalendarQuota:
+		return b.quotaAvailable(now, b.quota)
+	case Concurrency:
+		return 0
+	}
+	tokens, added, _ := b.refill(now, r)
+	return tokens + added
+}
+
+// refill returns the current number of tokens in the Bucket, the number of tokens that
+// would be added to it at time now with the given filling Rate, and the elapsed time since
+// the last successful Take. It must be called with the lock held.
+func (b *Bucket) refill(now time.Time, r Rate) (tokens, added float64, elapsed time.Duration) {
 	// Capacity is the number of tokens that can be taken out of the bucket in
 	// a single Take call, also known as burstiness.
-	capacity := float64(r.Freq)
+	capacity := r.capacity()
 
-	if b.added == 0 {
-		b.added = capacity
+	// Calculate the current number of tokens. A Bucket that was never taken
+	// from starts full.
+	if tokens = b.added - b.taken; b.added == 0 {
+		tokens = capacity - b.taken
 	}
 
 	last := b.created.Add(b.elapsed)
@@ -200,28 +626,116 @@ func (b *Bucket) Take(now time.Time, r Rate, n uint64) (remaining uint64, ok boo
 		last = now
 	}
 
-	// Calculate the current number of tokens.
-	tokens := b.added - b.taken
-
 	// Calculate the elapsed time since the last successful Take.
-	elapsed := now.Sub(last)
+	elapsed = now.Sub(last)
 
 	// Calculate the added number of tokens due to elapsed time.
-	added := r.Tokens(elapsed)
+	added = r.Tokens(elapsed)
 	if missing := capacity - tokens; added > missing {
 		added = missing
 	}
 
-	taken := float64(n)
-	if have := tokens + added; taken > have {
-		return uint64(have), false
+	return tokens, added, elapsed
+}
+
+// Refill fills the Bucket up to its capacity at the given Rate.
+//
+// Since merging Buckets picks the maximum of each counter, the tokens taken can't be
+// reset. Instead, enough tokens are added to offset them, which replicates safely.
+// For the same reason, Buckets of other Algorithms can't be refilled, which is a no-op.
+func (b *Bucket) Refill(r Rate) {
+	b.mu.Lock()
+	if b.algo != TokenBucket {
+		b.mu.Unlock()
+		return
+	}
+	if full := b.taken + r.capacity(); b.added < full {
+		b.added = full
 	}
+	b.mu.Unlock()
+}
 
-	b.elapsed += elapsed
-	b.added += added
-	b.taken += taken
+// Credit gives n tokens back to the Bucket, up to its capacity at the given Rate,
+// and returns the number of tokens in it afterwards.
+//
+// Like Refill, it only ever adds tokens, which replicates safely. However, like takes,
+// concurrent credits to the same Bucket on different nodes merge to the largest of them.
+// Buckets of other Algorithms can't be credited, which is a no-op that returns zero.
+func (b *Bucket) Credit(r Rate, n uint64) (remaining uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	return uint64(b.added - b.taken), true
+	if b.algo != TokenBucket {
+		return 0
+	}
+
+	if b.added == 0 {
+		b.added = r.capacity()
+	}
+
+	added := b.added + float64(n)
+	if full := b.taken + r.capacity(); added > full {
+		added = full
+	}
+
+	if b.added < added {
+		b.added = added
+	}
+
+	return uint64(b.added - b.taken)
+}
+
+// lastRate returns the Rate of the last Take on the Bucket in this node.
+func (b *Bucket) lastRate() Rate {
+	b.mu.RLock()
+	r := b.rate
+	b.mu.RUnlock()
+	return r
+}
+
+// Expired returns true if the Bucket has been idle for longer than the given ttl
+// at time now and has fully refilled at the Rate of its last Take, so that
+// dropping it is indistinguishable from creating it anew. Buckets that were
+// never taken from in this node, such as those only merged from peers or restored,
+// don't know their Rate, so they expire once they weren't touched for ttl instead.
+// Taking from them again asks the cluster for their state anew.
+func (b *Bucket) Expired(now time.Time, ttl time.Duration) bool {
+	if b.Algorithm() == Concurrency {
+		return b.leasesExpired(now, ttl)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	switch b.algo {
+	case GCRA:
+		return b.gcraExpired(now, ttl)
+	case SlidingWindow, FixedWindow:
+		return b.windowExpired(now, ttl)
+	case CalendarQuota:
+		return b.quotaExpired(now, ttl)
+	}
+
+	if b.rate.IsZero() {
+		return b.untouched(now, ttl)
+	}
+
+	idle := now.Sub(b.created.Add(b.elapsed))
+	if idle < ttl {
+		return false
+	}
+
+	return b.added-b.taken+b.rate.Tokens(idle) >= b.rate.capacity()
+}
+
+// untouched returns true if the Bucket wasn't created nor touched for at least ttl
+// at time now.
+func (b *Bucket) untouched(now time.Time, ttl time.Duration) bool {
+	last := b.created
+	if ns := atomic.LoadInt64(&b.touched); ns > last.UnixNano() || last.IsZero() {
+		last = time.Unix(0, ns)
+	}
+	return now.Sub(last) >= ttl
 }
 
 // String implements the Stringer interface.
@@ -235,8 +749,30 @@ func (b *Bucket) String() string {
 	return s
 }
 
+// Conflicts returns true if both Buckets of the same generation were taken from with
+// different Algorithms, so that Merge skips the other.
+func (b *Bucket) Conflicts(other *Bucket) bool {
+	if other == b {
+		return false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	return b.generation == other.generation && b.algo != other.algo && !b.isZero() && !other.isZero()
+}
+
 // Merge merges multiple Buckets using PN-counter CRDT semantics with
-// its counters, picking the largest value for each field.
+// its counters, picking the largest value for each field. The window counts of
+// window based Buckets are merged per window.
+//
+// The state of one Algorithm can't be merged into another's, so a zero Bucket takes
+// the Algorithm of the others, but the others are skipped once it's taken from with a
+// different Algorithm. Use Conflicts to detect those.
+//
+// Buckets of an older generation than b are skipped, and a newer generation resets b
+// before merging it, so that a Reset on any node reaches the whole cluster.
 func (b *Bucket) Merge(others ...*Bucket) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -247,6 +783,24 @@ func (b *Bucket) Merge(others ...*Bucket) {
 		}
 
 		other.mu.RLock()
+		switch {
+		case other.generation < b.generation:
+			other.mu.RUnlock()
+			continue
+		case other.generation > b.generation:
+			b.reset()
+			b.leases = nil
+			b.algo, b.generation = other.algo, other.generation
+		}
+
+		if b.algo != other.algo {
+			if other.isZero() || !b.isZero() {
+				other.mu.RUnlock()
+				continue
+			}
+			b.algo = other.algo
+		}
+
 		if b.added < other.added { // Find the maximum added
 			b.added = other.added
 		}
@@ -258,6 +812,20 @@ func (b *Bucket) Merge(others ...*Bucket) {
 		if b.elapsed < other.elapsed { // Find the largest elapsed time.
 			b.elapsed = other.elapsed
 		}
+
+		if b.tat < other.tat { // Find the latest theoretical arrival time.
+			b.tat = other.tat
+		}
+
+		if b.acquired < other.acquired { // Find the maximum acquired leases.
+			b.acquired = other.acquired
+		}
+
+		if b.released < other.released { // Find the maximum released leases.
+			b.released = other.released
+		}
+
+		b.mergeWindows(other)
 		other.mu.RUnlock()
 	}
 }
@@ -65,11 +65,319 @@ func TestBucket_Take(t *testing.T) {
 	}
 }
 
+func TestBucket_TakeBurst(t *testing.T) {
+	type step struct {
+		elapsed time.Duration
+		take    uint64
+		ok      bool
+		rem     uint64
+	}
+
+	for _, tc := range []struct {
+		burst int
+		steps []step
+	}{
+		{
+			burst: 2, // Smooth
+			steps: []step{
+				{elapsed: 0, take: 3, ok: false, rem: 2},                     // Burst caps initial tokens
+				{elapsed: 0, take: 2, ok: true, rem: 0},                      // Take the whole burst
+				{elapsed: 0, take: 1, ok: false, rem: 0},                     // Empty
+				{elapsed: 100 * time.Millisecond, take: 1, ok: true, rem: 0}, // Refilled at 10/s
+				{elapsed: time.Second, take: 0, ok: true, rem: 2},            // Refill capped at burst
+			},
+		},
+		{
+			burst: 20, // Spiky
+			steps: []step{
+				{elapsed: 0, take: 20, ok: true, rem: 0},                 // Take the whole burst
+				{elapsed: time.Second, take: 0, ok: true, rem: 10},       // Refilled at 10/s
+				{elapsed: 5 * time.Second, take: 21, ok: false, rem: 20}, // Refill capped at burst
+			},
+		},
+	} {
+		rate := Rate{Freq: 10, Per: time.Second, Burst: tc.burst}
+		bucket := Bucket{created: time.Now()}
+		now := bucket.created
+
+		for i, step := range tc.steps {
+			now = now.Add(step.elapsed)
+			if rem, ok := bucket.Take(now, rate, step.take); ok != step.ok || rem != step.rem {
+				t.Errorf("burst %d, step %d: have (%t, %d), want (%t, %d)", tc.burst, i, ok, rem, step.ok, step.rem)
+			}
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Rate
+		err  bool
+	}{
+		{in: "10", want: Rate{Freq: 10, Per: time.Second}},
+		{in: "10:m", want: Rate{Freq: 10, Per: time.Minute}},
+		{in: "100:1m:10", want: Rate{Freq: 100, Per: time.Minute, Burst: 10}},
+		{in: "100:1m:x", err: true},
+		{in: "100:1m:-1", err: true},
+		{in: "0:1s", err: true},
+		{in: "10:0s", err: true},
+		{in: "30/1m", err: true},
+	} {
+		have, err := ParseRate(tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("ParseRate(%q): have error %v, want error %t", tc.in, err, tc.err)
+		} else if err == nil && have != tc.want {
+			t.Errorf("ParseRate(%q): have %+v, want %+v", tc.in, have, tc.want)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if again, err := ParseRate(have.String()); err != nil || again != have {
+			t.Errorf("ParseRate(%q): have (%+v, %v), want (%+v, nil)", have, again, err, have)
+		}
+	}
+}
+
+func TestBucket_Peek(t *testing.T) {
+	rate := Rate{Freq: 5, Per: time.Second}
+	bucket := Bucket{created: time.Now()}
+	now := bucket.created
+
+	for i, n := range []uint64{1, 3, 2, 1, 0, 5} {
+		now = now.Add(rate.Interval() / 2)
+
+		before := bucket.String()
+		pr, pok := bucket.Peek(now, rate, n)
+		if after := bucket.String(); after != before {
+			t.Fatalf("step %d: Peek mutated the bucket: %s != %s", i, after, before)
+		}
+
+		if tr, tok := bucket.Take(now, rate, n); pr != tr || pok != tok {
+			t.Errorf("step %d: Peek(%d) = (%d, %t), Take(%d) = (%d, %t)", i, n, pr, pok, n, tr, tok)
+		}
+	}
+}
+
+func TestBucket_Delay(t *testing.T) {
+	rate := Rate{Freq: 5, Per: time.Second}
+	bucket := Bucket{created: time.Now()}
+	now := bucket.created
+
+	if _, ok := bucket.Take(now, rate, 4); !ok {
+		t.Fatal("take should succeed")
+	}
+
+	for _, tc := range []struct {
+		n     uint64
+		delay time.Duration
+		ok    bool
+	}{
+		{n: 0, delay: 0, ok: true},
+		{n: 1, delay: 0, ok: true},
+		{n: 2, delay: rate.Interval(), ok: true},
+		{n: 5, delay: 4 * rate.Interval(), ok: true},
+		{n: 6, delay: 0, ok: false}, // Exceeds capacity
+	} {
+		delay, ok := bucket.Delay(now, rate, tc.n)
+		if delay != tc.delay || ok != tc.ok {
+			t.Errorf("Delay(%d): have (%s, %t), want (%s, %t)", tc.n, delay, ok, tc.delay, tc.ok)
+		}
+	}
+
+	if remaining, ok := bucket.Take(now.Add(4*rate.Interval()), rate, 5); !ok || remaining != 0 {
+		t.Errorf("Take after delay: have (%d, %t), want (0, true)", remaining, ok)
+	}
+}
+
+func TestBucket_Refill(t *testing.T) {
+	rate := Rate{Freq: 5, Per: time.Hour}
+	bucket := Bucket{created: time.Now()}
+	now := bucket.created
+
+	if _, ok := bucket.Take(now, rate, 5); !ok {
+		t.Fatal("take should succeed")
+	}
+
+	// A replica that hasn't seen the refill yet.
+	var replica Bucket
+	replica.Merge(&bucket)
+
+	bucket.Refill(rate)
+	if have, want := bucket.Tokens(), uint64(5); have != want {
+		t.Errorf("have %d tokens after refill, want %d", have, want)
+	}
+
+	// Refills survive merges with stale state in any direction.
+	replica.Merge(&bucket)
+	bucket.Merge(&replica)
+	for _, b := range []*Bucket{&bucket, &replica} {
+		if have, want := b.Tokens(), uint64(5); have != want {
+			t.Errorf("have %d tokens after merge, want %d", have, want)
+		}
+	}
+}
+
+func TestTakeAll(t *testing.T) {
+	now := time.Now()
+	rate := Rate{Freq: 2, Per: time.Hour}
+	a := &Bucket{name: "a", created: now}
+	b := &Bucket{name: "b", created: now}
+
+	// b can't satisfy both takes, so nothing is taken from a nor b.
+	takes := []BucketTake{
+		{Bucket: a, Rate: rate, N: 1},
+		{Bucket: b, Rate: rate, N: 1},
+		{Bucket: b, Rate: rate, N: 2},
+	}
+
+	if ok, err := TakeAll(now, takes); ok || err != nil {
+		t.Fatalf("TakeAll should fail without error: %v", err)
+	}
+
+	for i, want := range []BucketTake{
+		{Remaining: 2, OK: true},
+		{Remaining: 2, OK: true},
+		{Remaining: 2, OK: false},
+	} {
+		if have := takes[i]; have.Remaining != want.Remaining || have.OK != want.OK {
+			t.Errorf("take %d: have (%d, %t), want (%d, %t)", i, have.Remaining, have.OK, want.Remaining, want.OK)
+		}
+	}
+
+	for _, bucket := range []*Bucket{a, b} {
+		if !bucket.IsZero() {
+			t.Errorf("bucket %q should be untouched: %v", bucket.name, bucket)
+		}
+	}
+
+	takes = takes[:2]
+	if ok, err := TakeAll(now, takes); !ok || err != nil {
+		t.Fatalf("TakeAll should succeed: %v", err)
+	}
+
+	for _, bucket := range []*Bucket{a, b} {
+		if have, want := bucket.Tokens(), uint64(1); have != want {
+			t.Errorf("bucket %q: have %d tokens, want %d", bucket.name, have, want)
+		}
+	}
+
+	quota := &Bucket{name: "quota", created: now, algo: CalendarQuota}
+	takes = append(takes, BucketTake{Bucket: quota, Rate: rate, N: 1})
+	if ok, err := TakeAll(now, takes); ok || err == nil {
+		t.Fatal("TakeAll should fail with an error on a quota Bucket")
+	}
+
+	for _, bucket := range []*Bucket{a, b} {
+		if have, want := bucket.Tokens(), uint64(1); have != want {
+			t.Errorf("bucket %q: have %d tokens after error, want %d", bucket.name, have, want)
+		}
+	}
+
+	// Concurrent calls with Buckets in opposite orders must not deadlock.
+	done := make(chan struct{})
+	for _, order := range [][]*Bucket{{a, b}, {b, a}} {
+		go func(order []*Bucket) {
+			for i := 0; i < 1000; i++ {
+				TakeAll(now, []BucketTake{{Bucket: order[0], Rate: rate}, {Bucket: order[1], Rate: rate}})
+			}
+			done <- struct{}{}
+		}(order)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("deadlock")
+		}
+	}
+}
+
+func TestBucket_Credit(t *testing.T) {
+	rate := Rate{Freq: 5, Per: time.Hour}
+	bucket := Bucket{created: time.Now()}
+	now := bucket.created
+
+	if _, ok := bucket.Take(now, rate, 4); !ok {
+		t.Fatal("take should succeed")
+	}
+
+	var replica Bucket
+	replica.Merge(&bucket)
+
+	for _, tc := range []struct{ n, remaining uint64 }{
+		{n: 0, remaining: 1},
+		{n: 2, remaining: 3},
+		{n: 5, remaining: 5}, // Capped at capacity.
+	} {
+		if have := bucket.Credit(rate, tc.n); have != tc.remaining {
+			t.Errorf("Credit(%d): have %d remaining, want %d", tc.n, have, tc.remaining)
+		}
+	}
+
+	if replica.Merge(&bucket); replica.Tokens() != 5 {
+		t.Errorf("have %d tokens in replica after merge, want 5", replica.Tokens())
+	}
+}
+
+func TestBucket_Reset(t *testing.T) {
+	rate := Rate{Freq: 5, Per: time.Hour}
+	now := time.Now()
+
+	bucket := &Bucket{created: now, algo: SlidingWindow}
+	if _, ok := bucket.Take(now, rate, 5); !ok {
+		t.Fatal("take should succeed")
+	}
+
+	// A replica that hasn't seen the reset yet.
+	replica := &Bucket{created: now}
+	replica.Merge(bucket)
+
+	bucket.Reset()
+	if bucket.IsZero() {
+		t.Error("want reset Bucket to replicate its generation")
+	}
+
+	// Stale state is skipped, and the reset replaces it on merge.
+	bucket.Merge(replica)
+	replica.Merge(bucket)
+	for _, b := range []*Bucket{bucket, replica} {
+		if have, ok := b.Peek(now, rate, 5); !ok {
+			t.Errorf("have %d tokens after merge, want 5", have)
+		}
+	}
+
+	// Leases granted before the reset are dropped along with the counters.
+	leased := &Bucket{created: now, algo: Concurrency}
+	lease, _, _ := leased.Acquire(now, 1, time.Minute)
+	reset := &Bucket{algo: Concurrency}
+	reset.Merge(leased)
+	reset.Reset()
+
+	leased.Merge(reset)
+	if n := leased.InFlight(now); n != 0 {
+		t.Errorf("have %d leases in flight after reset, want 0", n)
+	}
+	if leased.Release(now, lease.ID) {
+		t.Error("want lease granted before the reset to be unknown")
+	}
+
+	// TokenBuckets replicate no generation and are refilled instead.
+	token := &Bucket{created: now}
+	token.Take(now, rate, 5)
+	if token.Reset(); token.Tokens() != 0 {
+		t.Error("want Reset to be a no-op for TokenBuckets")
+	}
+}
+
 func TestBucket_Merge(t *testing.T) {
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	buckets := make([]Bucket, 100)
+	buckets := make([]*Bucket, 100)
 	for i := range buckets {
-		buckets[i] = Bucket{
+		buckets[i] = &Bucket{
 			added:   rng.Float64(),              // The P of the PN counter "tokens".
 			taken:   rng.Float64(),              // The N of the PN counter "tokens".
 			elapsed: time.Duration(rng.Int63()), // A separate "elapsed" duration G-Counter.
@@ -79,7 +387,7 @@ func TestBucket_Merge(t *testing.T) {
 	// Compute the result of a merged bucket with sequential operations.
 	var sequential Bucket
 	for _, bucket := range buckets {
-		sequential.Merge(&sequential, &bucket)
+		sequential.Merge(&sequential, bucket)
 	}
 
 	// Compute multiple random sequences of merge operations and compare with
@@ -99,13 +407,13 @@ func TestBucket_Merge(t *testing.T) {
 		var random Bucket
 		for _, bucket := range buckets {
 			// Explicitly test idempotence by merging the same bucket twice.
-			random.Merge(&bucket, &bucket)
+			random.Merge(bucket, bucket)
 		}
 
 		if random != sequential {
 			t.Fatalf(
 				"Buckets merged in random order diverged from sequential result:\nhave: %v\nwant: %v\nbuckets: %v",
-				random,
+				&random,
 				&sequential,
 				buckets,
 			)
@@ -19,6 +19,14 @@ func main() {
 		APIAddr:         "127.0.0.1:8080",
 		NodeAddr:        "127.0.0.1:16000",
 		ShutdownTimeout: 30 * time.Second,
+		BucketTTL:       10 * time.Minute,
+		Shards:          runtime.NumCPU(),
+		SnapshotPeriod:  time.Minute,
+		Journal: patrol.JournalOptions{
+			Sync:          patrol.SyncPeriodic,
+			SyncPeriod:    time.Second,
+			CompactPeriod: 10 * time.Minute,
+		},
 	}
 
 	runtime.SetMutexProfileFraction(50)
@@ -26,17 +34,39 @@ func main() {
 	fs.StringVar(&cmd.APIAddr, "api-addr", cmd.APIAddr, "HTTP API address")
 	fs.StringVar(&cmd.NodeAddr, "node-addr", cmd.NodeAddr, "Node address")
 	fs.Var(&addrsFlag{addrs: &cmd.PeerAddrs}, "peer-addr", "Peer node address")
+	fs.DurationVar(&cmd.BucketTTL, "bucket-ttl", cmd.BucketTTL, "Idle time after which full buckets are evicted (0 disables eviction)")
+	fs.IntVar(&cmd.MaxBuckets, "max-buckets", cmd.MaxBuckets, "Maximum number of buckets held in memory (0 means unbounded)")
+	fs.IntVar(&cmd.Shards, "shards", cmd.Shards, "Number of independently locked bucket repo shards")
+	fs.StringVar(&cmd.PolicyFile, "policy-file", cmd.PolicyFile, "JSON file of policies that set the limits of buckets by name")
+	fs.StringVar(&cmd.SnapshotFile, "snapshot-file", cmd.SnapshotFile, "File where bucket state is snapshotted and restored from on startup")
+	fs.DurationVar(&cmd.SnapshotPeriod, "snapshot-period", cmd.SnapshotPeriod, "Interval between bucket snapshots (0 only snapshots on shutdown)")
+	fs.StringVar(&cmd.JournalFile, "journal-file", cmd.JournalFile, "Append-only file where bucket changes are journaled and replayed from on startup")
+	fs.DurationVar(&cmd.Journal.SyncPeriod, "journal-sync-period", cmd.Journal.SyncPeriod, "Interval between journal fsyncs with -journal-sync=periodic")
+	fs.DurationVar(&cmd.Journal.CompactPeriod, "journal-compact-period", cmd.Journal.CompactPeriod, "Interval between journal compactions (0 disables compaction)")
 
+	journalSync := fs.String("journal-sync", cmd.Journal.Sync.String(), "When the journal is fsynced [always | periodic | never]")
+	defaultRate := fs.String("default-rate", "", "Rate of take requests that don't specify one (e.g. 100:1m)")
 	offset := fs.Duration("clock-offset", 0, "Offset to add to clock timestamps (for testing)")
 	logenv := fs.String("log-env", "production", "Logging environment [development | production]")
 
 	fs.Parse(os.Args[1:])
 
+	if *defaultRate != "" {
+		var err error
+		if cmd.DefaultRate, err = patrol.ParseRate(*defaultRate); err != nil {
+			log.Fatalf("invalid -default-rate value %q: %v", *defaultRate, err)
+		}
+	}
+
+	var err error
+	if cmd.Journal.Sync, err = patrol.ParseSyncPolicy(*journalSync); err != nil {
+		log.Fatalf("invalid -journal-sync value %q: %v", *journalSync, err)
+	}
+
 	cmd.Clock = func() time.Time {
 		return time.Now().UTC().Add(*offset)
 	}
 
-	var err error
 	switch *logenv {
 	case "development":
 		cmd.Log, err = zap.NewDevelopment()
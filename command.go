@@ -3,9 +3,11 @@ package patrol
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/oklog/run"
@@ -22,6 +24,20 @@ type Command struct {
 	PeerAddrs       []string
 	Clock           func() time.Time // For testing
 	ShutdownTimeout time.Duration
+	BucketTTL       time.Duration // Zero disables Bucket eviction.
+	MaxBuckets      int           // Zero means unbounded.
+	Shards          int           // Number of Repo shards. Defaults to one.
+	DefaultRate     Rate          // Rate of take requests that don't specify one.
+	PolicyFile      string        // Path of the JSON file of Policies. Optional.
+	SnapshotFile    string        // Path of the Bucket snapshot file. Optional.
+	SnapshotPeriod  time.Duration // Zero only snapshots on shutdown.
+	JournalFile     string        // Path of the Bucket journal file. Optional.
+	Journal         JournalOptions
+
+	// For testing, so that listeners on random ports and signals are injected instead.
+	apiListener net.Listener   // Listens on APIAddr when nil.
+	nodeConn    net.PacketConn // Listens on NodeAddr when nil.
+	signals     chan os.Signal // Notified of process signals when nil.
 }
 
 // Run runs the Command and blocks until completion.
@@ -30,13 +46,63 @@ func (c *Command) Run(ctx context.Context) (err error) {
 		return fmt.Errorf("ShutdownTimeout must be set")
 	}
 
-	repo, err := NewReplicatedRepo(c.Log, NewLocalRepo(c.Clock), c.NodeAddr, c.PeerAddrs)
-	if err != nil {
-		return err
+	var snapshot []*Bucket
+	if c.SnapshotFile != "" {
+		switch snapshot, err = LoadSnapshot(c.SnapshotFile); {
+		case err == nil:
+			c.Log.Info("loaded snapshot", zap.String("file", c.SnapshotFile), zap.Int("buckets", len(snapshot)))
+		case os.IsNotExist(err):
+		default: // Start empty rather than from corrupted state.
+			c.Log.Error("rejected snapshot", zap.String("file", c.SnapshotFile), zap.Error(err))
+		}
+	}
+
+	local := NewShardedRepo(c.Clock, c.Shards, c.MaxBuckets, snapshot...)
+
+	var (
+		stored  Repo = local
+		journal *JournalRepo
+	)
+
+	if c.JournalFile != "" {
+		if journal, err = NewJournalRepo(c.Log, local, c.JournalFile, c.Journal); err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := journal.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+		stored = journal
 	}
 
+	conn := c.nodeConn
+	if conn == nil {
+		if conn, err = net.ListenPacket("udp", c.NodeAddr); err != nil {
+			return err
+		}
+	}
+	repo := newReplicatedRepo(c.Log, stored, c.NodeAddr, conn, c.PeerAddrs)
+	defer func() { // Before the journal is closed.
+		if cerr := repo.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
 	defer c.Log.Sync()
-	api := NewAPI(c.Log, c.Clock, repo)
+	api := NewAPIWithDefaultRate(c.Log, c.Clock, repo, c.DefaultRate)
+	if c.PolicyFile != "" {
+		if err = api.LoadPolicies(c.PolicyFile); err != nil {
+			return err
+		}
+	}
+
+	ln := c.apiListener
+	if ln == nil {
+		if ln, err = net.Listen("tcp", c.APIAddr); err != nil {
+			return err
+		}
+	}
 
 	srv := http.Server{
 		Addr:    c.APIAddr,
@@ -46,10 +112,12 @@ func (c *Command) Run(ctx context.Context) (err error) {
 	var g run.Group
 	{ // HTTP API
 		g.Add(func() error {
-			c.Log.Info("API serving", zap.String("addr", c.APIAddr))
-			return srv.ListenAndServe()
+			c.Log.Info("API serving", zap.Stringer("addr", ln.Addr()))
+			return srv.Serve(ln)
 		}, func(error) {
-			ctx, cancel := context.WithTimeout(ctx, c.ShutdownTimeout)
+			// Not derived from ctx, which may be done already, so that in-flight
+			// requests get the full timeout to complete.
+			ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
 			defer cancel()
 			srv.Shutdown(ctx)
 		})
@@ -64,20 +132,101 @@ func (c *Command) Run(ctx context.Context) (err error) {
 		})
 	}
 
+	if c.BucketTTL > 0 { // Bucket eviction
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			c.Log.Info("evicting buckets", zap.Duration("ttl", c.BucketTTL))
+			return local.Sweep(ctx, c.BucketTTL/2, c.BucketTTL)
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	if journal != nil { // Journal syncing and compaction
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			c.Log.Info("journaling buckets", zap.String("file", c.JournalFile), zap.Stringer("sync", c.Journal.Sync))
+			return journal.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	if c.SnapshotFile != "" && c.SnapshotPeriod > 0 { // Periodic snapshots
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			ticker := time.NewTicker(c.SnapshotPeriod)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					c.snapshot(ctx, local)
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}, func(error) {
+			cancel()
+		})
+	}
+
 	{ // Signal handling and cancellation
 		ctx, cancel := context.WithCancel(ctx)
 		g.Add(func() error {
-			sigch := make(chan os.Signal, 1)
-			signal.Notify(sigch, os.Interrupt)
-			select {
-			case <-sigch:
-			case <-ctx.Done():
+			sigch := c.signals
+			if sigch == nil {
+				sigch = make(chan os.Signal, 1)
+				signal.Notify(sigch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+				defer signal.Stop(sigch)
+			}
+			for {
+				select {
+				case sig := <-sigch:
+					if sig != syscall.SIGHUP {
+						c.Log.Info("shutting down", zap.Stringer("signal", sig))
+						return nil
+					}
+					// Failures are logged and keep the current policies.
+					if c.PolicyFile != "" {
+						api.ReloadPolicies()
+					}
+				case <-ctx.Done():
+					return nil
+				}
 			}
-			return nil
 		}, func(error) {
 			cancel()
 		})
 	}
 
-	return g.Run()
+	err = g.Run()
+
+	// The API is shut down, so Buckets are no longer taken, other than by requests that
+	// outlived the ShutdownTimeout, whose broadcasts wait for the drain. Push the final
+	// state of all Buckets to peers before the replication connection is closed.
+	drainCtx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+
+	if synced, derr := repo.Drain(drainCtx); derr != nil {
+		c.Log.Error("draining replication", zap.Int("synced", synced), zap.Error(derr))
+	} else {
+		c.Log.Info("drained replication", zap.Int("synced", synced))
+	}
+
+	if c.SnapshotFile != "" {
+		c.snapshot(drainCtx, local)
+	}
+
+	return err
+}
+
+// snapshot saves all Buckets in the given Repo to the SnapshotFile. Failures are
+// logged, keeping the previous snapshot.
+func (c *Command) snapshot(ctx context.Context, r Repo) {
+	bs := allBuckets(ctx, r)
+	if err := SaveSnapshot(c.SnapshotFile, bs); err != nil {
+		c.Log.Error("saving snapshot", zap.String("file", c.SnapshotFile), zap.Error(err))
+	} else {
+		c.Log.Debug("saved snapshot", zap.String("file", c.SnapshotFile), zap.Int("buckets", len(bs)))
+	}
 }
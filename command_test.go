@@ -2,6 +2,12 @@ package patrol
 
 import (
 	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -13,46 +19,44 @@ import (
 func TestCommand(t *testing.T) {
 	ctx := context.Background()
 
-	apis := []string{
-		"127.0.0.1:12000",
-		"127.0.0.1:12001",
-		"127.0.0.1:12002",
-	}
-
-	nodes := []string{
-		"127.0.0.1:16000",
-		"127.0.0.1:16001",
-		"127.0.0.1:16002",
-	}
+	var (
+		apis  []string
+		nodes []string
+		cmds  []*Command
+	)
 
-	peers := func(node string, nodes []string) []string {
-		var peers []string
-		for i := range nodes {
-			if nodes[i] != node {
-				peers = append(peers, node)
-			}
-		}
-		return peers
-	}
-
-	var g run.Group
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	for i, node := range nodes {
+	for i := 0; i < 3; i++ {
+		api, node := listen(t)
+		apis = append(apis, api.Addr().String())
+		nodes = append(nodes, node.LocalAddr().String())
+
 		offset := time.Duration(i) * time.Minute
-		cmd := Command{
-			Log:       logger,
-			APIAddr:   apis[i],
-			NodeAddr:  node,
-			PeerAddrs: peers(node, nodes),
+		cmds = append(cmds, &Command{
+			Log:      logger,
+			APIAddr:  api.Addr().String(),
+			NodeAddr: node.LocalAddr().String(),
 			Clock: func() time.Time {
 				// Test that unsynchronized clocks don't affect results.
 				return time.Now().UTC().Add(offset)
 			},
 			ShutdownTimeout: 5 * time.Second,
+			apiListener:     api,
+			nodeConn:        node,
+		})
+	}
+
+	var g run.Group
+	for _, cmd := range cmds {
+		cmd := cmd
+		for _, node := range nodes {
+			if node != cmd.NodeAddr {
+				cmd.PeerAddrs = append(cmd.PeerAddrs, node)
+			}
 		}
 
 		ctx, cancel := context.WithCancel(ctx)
@@ -76,6 +80,22 @@ func TestCommand(t *testing.T) {
 	}
 }
 
+// listen returns an API listener and a replication connection on random local ports.
+func listen(t *testing.T) (net.Listener, net.PacketConn) {
+	api, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		api.Close()
+		t.Fatal(err)
+	}
+
+	return api, node
+}
+
 func testCommand(t *testing.T, nodes []string) {
 	a := vegeta.NewAttacker(vegeta.H2C(true))
 
@@ -105,3 +125,172 @@ func testCommand(t *testing.T, nodes []string) {
 		t.Errorf("success rate should be below 0.9: got %f", m.Success)
 	}
 }
+
+func TestCommand_Shutdown(t *testing.T) {
+	// A fake peer which records the Buckets it's sent.
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	received := make(chan *Bucket, 16)
+	go func() {
+		buf := make([]byte, bucketPacketSize)
+		for {
+			n, _, err := peer.ReadFrom(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			var b Bucket
+			if err := b.UnmarshalBinary(buf[:n]); err == nil && !b.IsZero() {
+				received <- &b
+			}
+		}
+	}()
+
+	api, node := listen(t)
+	cmd := Command{
+		Log:             zap.NewNop(),
+		APIAddr:         api.Addr().String(),
+		NodeAddr:        node.LocalAddr().String(),
+		PeerAddrs:       []string{peer.LocalAddr().String()},
+		Clock:           time.Now,
+		ShutdownTimeout: 5 * time.Second,
+		apiListener:     api,
+		nodeConn:        node,
+		signals:         make(chan os.Signal, 1),
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Run(context.Background()) }()
+
+	// Wait until the API is serving.
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = http.Post("http://"+cmd.APIAddr+"/take/foo?rate=10:s", "", nil)
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	cmd.signals <- syscall.SIGTERM
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after SIGTERM")
+	}
+
+	// The take is broadcast once and then again when draining.
+	for i := 0; i < 2; i++ {
+		select {
+		case b := <-received:
+			if b.name != "foo" || b.taken != 1 {
+				t.Errorf("received %s with %v taken, want foo with 1 taken", b.name, b.taken)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("received %d Bucket packets, want 2", i)
+		}
+	}
+
+	// The replication connection is closed, so its address can be bound again.
+	conn, err := net.ListenPacket("udp", cmd.NodeAddr)
+	if err != nil {
+		t.Fatalf("replication connection not closed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestCommand_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patrol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := Command{
+		Log:             zap.NewNop(),
+		Clock:           time.Now,
+		ShutdownTimeout: 5 * time.Second,
+		SnapshotFile:    filepath.Join(dir, "snapshot"),
+	}
+
+	take := func() int {
+		var resp *http.Response
+		for i := 0; i < 50; i++ { // Wait until the API is serving.
+			if resp, err = http.Post("http://"+cmd.APIAddr+"/take/foo?rate=1:h", "", nil); err == nil {
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatal(err)
+		return 0
+	}
+
+	for _, want := range []int{
+		http.StatusOK,
+		http.StatusTooManyRequests, // Restarted from the snapshot saved on shutdown.
+	} {
+		cmd.apiListener, cmd.nodeConn = listen(t)
+		cmd.APIAddr = cmd.apiListener.Addr().String()
+		cmd.NodeAddr = cmd.nodeConn.LocalAddr().String()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- cmd.Run(ctx) }()
+
+		if have := take(); have != want {
+			t.Errorf("have status %d, want %d", have, want)
+		}
+
+		cancel()
+		if err = <-done; err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	}
+}
+
+func TestCommand_PolicyFileError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patrol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	api, node := listen(t)
+	defer api.Close()
+
+	cmd := Command{
+		Log:             zap.NewNop(),
+		APIAddr:         api.Addr().String(),
+		NodeAddr:        node.LocalAddr().String(),
+		Clock:           time.Now,
+		ShutdownTimeout: 5 * time.Second,
+		PolicyFile:      filepath.Join(dir, "missing.json"),
+		JournalFile:     filepath.Join(dir, "journal"),
+		apiListener:     api,
+		nodeConn:        node,
+	}
+
+	if err = cmd.Run(context.Background()); !os.IsNotExist(err) {
+		t.Fatalf("have error %v, want the policy file to not exist", err)
+	}
+
+	// The replication connection is closed, so its address can be bound again.
+	conn, err := net.ListenPacket("udp", cmd.NodeAddr)
+	if err != nil {
+		t.Fatalf("replication connection not closed: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,81 @@
+package patrol
+
+import (
+	"math"
+	"time"
+)
+
+// GCRA Buckets only keep a theoretical arrival time (TAT): the time at which the Bucket
+// would be full again if no more tokens were taken. Taking n tokens pushes it forward by
+// n intervals of the Rate, and a take is allowed as long as the TAT doesn't end up more
+// than the Rate's capacity of intervals ahead of now.
+//
+// The TAT is an absolute Unix time so that it means the same on every node, which requires
+// loosely synchronized clocks. It only moves forward and is merged by taking the maximum,
+// which makes it a state based CRDT with the same semantics as the taken tokens of token
+// Buckets: concurrent takes on different nodes merge to the largest of them.
+
+// gcraAvailable returns the tokens that can be taken at time now.
+// It must be called with the lock held.
+func (b *Bucket) gcraAvailable(now time.Time, r Rate) float64 {
+	if r.IsZero() {
+		return 0
+	}
+
+	ahead := float64(b.tat - now.UnixNano())
+	if ahead < 0 {
+		ahead = 0
+	}
+
+	return math.Max(0, r.capacity()-ahead/gcraInterval(r))
+}
+
+// gcraInterval returns the Rate's interval between events in nanoseconds. Unlike Interval,
+// it isn't truncated, so that Rates of more than one event per nanosecond aren't unlimited.
+func gcraInterval(r Rate) float64 {
+	return float64(r.Per) / float64(r.Freq)
+}
+
+// gcraTake implements Take for GCRA Buckets. It must be called with the write lock held.
+func (b *Bucket) gcraTake(now time.Time, r Rate, n uint64) (remaining uint64, ok bool) {
+	if r.IsZero() {
+		return 0, false
+	}
+
+	have := b.gcraAvailable(now, r)
+
+	taken := float64(n)
+	if taken > have {
+		return uint64(have), false
+	}
+
+	if ns := now.UnixNano(); b.tat < ns {
+		b.tat = ns
+	}
+	b.tat += int64(math.Ceil(float64(n) * gcraInterval(r)))
+
+	return uint64(have - taken), true
+}
+
+// gcraDelay implements Delay for GCRA Buckets. It must be called with the read lock held.
+func (b *Bucket) gcraDelay(now time.Time, r Rate, n uint64) (time.Duration, bool) {
+	if float64(n) <= b.gcraAvailable(now, r) {
+		return 0, true
+	} else if float64(n) > r.capacity() || r.IsZero() {
+		return 0, false
+	}
+
+	// The TAT must be at most the remaining capacity of intervals ahead of now.
+	slack := time.Duration((r.capacity() - float64(n)) * gcraInterval(r))
+	return time.Duration(b.tat-now.UnixNano()) - slack, true
+}
+
+// gcraExpired returns true if the Bucket has been full for at least ttl at time now.
+// It must be called with the read lock held.
+func (b *Bucket) gcraExpired(now time.Time, ttl time.Duration) bool {
+	full := time.Unix(0, b.tat)
+	if full.Before(b.created) {
+		full = b.created
+	}
+	return now.Sub(full) >= ttl
+}
@@ -0,0 +1,143 @@
+package patrol
+
+import (
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestBucket_GCRAMarshaling(t *testing.T) {
+	prop := func(name string, tat int64) bool {
+		b := Bucket{name: name, algo: GCRA, tat: tat}
+		data, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded := Bucket{added: 1, window: 1}
+		if err = decoded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+
+		return b == decoded
+	}
+
+	if err := quick.Check(prop, &quick.Config{MaxCount: 1e5}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBucket_TakeGCRA(t *testing.T) {
+	rate := Rate{Freq: 10, Per: time.Second, Burst: 3} // One token every 100ms, 3 at once.
+	bucket := Bucket{algo: GCRA}
+	now := time.Unix(1000, 0)
+
+	for i, tc := range []struct {
+		elapsed time.Duration
+		take    uint64
+		ok      bool
+		rem     uint64
+	}{
+		{elapsed: 0, take: 3, ok: true, rem: 0},
+		{elapsed: 50 * time.Millisecond, take: 1, ok: false, rem: 0},
+		{elapsed: 50 * time.Millisecond, take: 1, ok: true, rem: 0},   // Exactly one interval later.
+		{elapsed: 100 * time.Millisecond, take: 2, ok: false, rem: 1}, // Tokens are spaced evenly.
+		{elapsed: time.Second, take: 4, ok: false, rem: 3},            // More than the capacity.
+		{elapsed: 0, take: 2, ok: true, rem: 1},
+	} {
+		now = now.Add(tc.elapsed)
+		rem, ok := bucket.Take(now, rate, tc.take)
+		if ok != tc.ok || rem != tc.rem {
+			t.Errorf("step %d: have (%t, %d), want (%t, %d)", i, ok, rem, tc.ok, tc.rem)
+		}
+	}
+}
+
+func TestBucket_TakeGCRAEdgeRates(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	bucket := Bucket{algo: GCRA}
+	if _, ok := bucket.Take(now, Rate{}, 0); ok {
+		t.Error("want takes at a zero rate to fail")
+	}
+
+	// Intervals of less than a nanosecond still limit takes.
+	rate := Rate{Freq: 2e9, Per: time.Second, Burst: 1}
+	if _, ok := bucket.Take(now, rate, 1); !ok {
+		t.Fatal("want first take to succeed")
+	}
+
+	if _, ok := bucket.Take(now, rate, 1); ok {
+		t.Error("want second take at the same time to fail")
+	}
+}
+
+func TestBucket_DelayGCRA(t *testing.T) {
+	rate := Rate{Freq: 10, Per: time.Second, Burst: 3}
+	now := time.Unix(1000, 0)
+
+	bucket := Bucket{algo: GCRA}
+	bucket.Take(now, rate, 3)
+
+	for _, tc := range []struct {
+		n     uint64
+		delay time.Duration
+		ok    bool
+	}{
+		{n: 1, delay: 100 * time.Millisecond, ok: true},
+		{n: 3, delay: 300 * time.Millisecond, ok: true},
+		{n: 4, ok: false},
+	} {
+		if delay, ok := bucket.Delay(now, rate, tc.n); delay != tc.delay || ok != tc.ok {
+			t.Errorf("Delay(%d): have (%s, %t), want (%s, %t)", tc.n, delay, ok, tc.delay, tc.ok)
+		}
+	}
+}
+
+func TestBucket_MergeGCRA(t *testing.T) {
+	rate := Rate{Freq: 10, Per: time.Second}
+	now := time.Unix(1000, 0)
+
+	a, b := Bucket{algo: GCRA}, Bucket{algo: GCRA}
+	a.Take(now, rate, 2)
+	b.Take(now, rate, 5)
+
+	a.Merge(&b)
+	b.Merge(&a)
+
+	if a != b {
+		t.Fatalf("replicas diverged after merging:\nhave: %v\nwant: %v", &a, &b)
+	}
+
+	if rem, _ := a.Peek(now, rate, 1); rem != 4 {
+		t.Errorf("have %d remaining after merge, want 4", rem)
+	}
+}
+
+func TestBucket_MergeConflict(t *testing.T) {
+	rate := Rate{Freq: 10, Per: time.Second}
+	now := time.Unix(1000, 0)
+
+	token, gcra := &Bucket{}, &Bucket{algo: GCRA}
+	token.Take(now, rate, 2)
+	gcra.Take(now, rate, 5)
+
+	if !token.Conflicts(gcra) {
+		t.Fatal("want token and GCRA Buckets to conflict")
+	}
+
+	token.Merge(gcra)
+	if token.Algorithm() != TokenBucket || token.tat != 0 {
+		t.Errorf("have %v, want the conflicting GCRA Bucket skipped", token)
+	}
+
+	zero := &Bucket{}
+	if zero.Merge(gcra); zero.Algorithm() != GCRA || zero.tat != gcra.tat {
+		t.Errorf("have %v, want the zero Bucket to take the GCRA state", zero)
+	}
+
+	// A zero Bucket of another Algorithm doesn't change it back.
+	if gcra.Merge(&Bucket{}); gcra.Algorithm() != GCRA {
+		t.Errorf("have %s, want GCRA", gcra.Algorithm())
+	}
+}
@@ -0,0 +1,517 @@
+package patrol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// A journal is an append-only log of Bucket mutations. It's laid out as:
+//
+//	magic    [4]byte  "PTRJ"
+//	version  uint32   journalVersion
+//	records, each:
+//	  checksum uint32  CRC-32C of the rest of the record
+//	  kind     uint8   journalUpsert or journalDelete
+//	  created  int64   local creation time of the Bucket in Unix nanoseconds, or zero
+//	  size     uint16  size of the data
+//	  data     [size]byte, the Bucket as marshaled by Bucket.MarshalBinary for upserts
+//	           or its name for deletes
+//
+// All integers are big endian. Since Buckets are merged by taking the maximum of
+// their state, replaying upserts in order converges to the latest state, and
+// compacting the journal only needs one upsert per Bucket.
+
+// journalVersion is the version of the journal format, which must be bumped
+// on any change to it or to the marshaled Bucket format.
+const journalVersion = 1
+
+var journalMagic = [4]byte{'P', 'T', 'R', 'J'}
+
+const (
+	journalHeaderSize = 4 + 4
+	journalRecordSize = 4 + 1 + 8 + 2 // Fixed portion of a record.
+)
+
+const (
+	journalUpsert byte = iota + 1
+	journalDelete
+)
+
+// A SyncPolicy defines when a JournalRepo flushes its journal to stable storage
+// with fsync, trading off write throughput for durability.
+type SyncPolicy uint8
+
+const (
+	// SyncPeriodic fsyncs every JournalOptions.SyncPeriod, so that machine crashes
+	// lose at most that much of the latest takes. It's the zero SyncPolicy.
+	SyncPeriodic SyncPolicy = iota
+	// SyncAlways fsyncs after every write, so that acknowledged takes survive
+	// machine crashes, at the cost of serializing takes on the disk's latency.
+	SyncAlways
+	// SyncNever leaves flushing to the operating system. Takes survive crashes of
+	// Patrol but not of the machine.
+	SyncNever
+)
+
+var syncPolicyNames = [...]string{
+	SyncPeriodic: "periodic",
+	SyncAlways:   "always",
+	SyncNever:    "never",
+}
+
+// ParseSyncPolicy returns the SyncPolicy with the given name.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	for p, n := range syncPolicyNames {
+		if n == name {
+			return SyncPolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %q", name)
+}
+
+// String implements the Stringer interface.
+func (p SyncPolicy) String() string {
+	if int(p) < len(syncPolicyNames) {
+		return syncPolicyNames[p]
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", p)
+}
+
+// JournalOptions configure a JournalRepo.
+type JournalOptions struct {
+	// Sync is the SyncPolicy of the journal.
+	Sync SyncPolicy
+	// SyncPeriod is the interval between fsyncs with SyncPeriodic, one second if zero.
+	SyncPeriod time.Duration
+	// CompactPeriod is the interval between compactions. Zero disables them.
+	CompactPeriod time.Duration
+}
+
+// A JournalRepo stores Buckets in another Repo and journals their upserts and deletes
+// to an append-only file, which is replayed when the JournalRepo is created so that
+// Buckets survive restarts and crashes. The journal is compacted periodically by
+// rewriting it with the current state of each Bucket.
+//
+// Only mutations made through the JournalRepo are journaled, so it's meant for single
+// node deployments: state merged from peers by a ReplicatedRepo is journaled with the
+// next local take on the same Bucket.
+//
+// Neither are evictions of the wrapped Repo journaled, so evicted Buckets are replayed
+// until the next compaction drops them. Replayed Buckets that were evicted for being
+// idle expire again, but may evict live ones from a Repo with a maximum size.
+type JournalRepo struct {
+	log      *zap.Logger
+	repo     Repo
+	opts     JournalOptions
+	filename string
+
+	mu   sync.Mutex // Serializes writes to the journal.
+	file *os.File
+	size int64 // Size of the journal in bytes.
+}
+
+// NewJournalRepo returns a new JournalRepo which journals to the given file, creating
+// it if it doesn't exist, after replaying its records into the given Repo. A torn
+// tail of the journal, as left by a crash while appending to it, is logged and
+// truncated. A journal of another version, or corrupted anywhere else, is rejected
+// with an error and left untouched.
+func NewJournalRepo(log *zap.Logger, r Repo, filename string, opts JournalOptions) (*JournalRepo, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.SyncPeriod <= 0 {
+		opts.SyncPeriod = time.Second
+	}
+
+	j := JournalRepo{log: log, repo: r, opts: opts, filename: filename, file: f}
+	if err = j.replay(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("replaying journal %s: %v", filename, err)
+	}
+
+	return &j, nil
+}
+
+// replay upserts and deletes the journaled Buckets into the wrapped Repo and prepares
+// the journal for appending.
+func (j *JournalRepo) replay() error {
+	ctx := context.Background()
+	br := bufio.NewReader(j.file)
+
+	var header [journalHeaderSize]byte
+	switch _, err := io.ReadFull(br, header[:]); {
+	case err == io.EOF || err == io.ErrUnexpectedEOF: // New or torn while being created.
+		if err = j.file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err = j.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return j.writeHeader()
+	case err != nil:
+		return err
+	case !bytes.Equal(header[:4], journalMagic[:]):
+		return errors.New("not a journal")
+	}
+
+	if v := binary.BigEndian.Uint32(header[4:]); v != journalVersion {
+		return fmt.Errorf("journal version %d isn't supported, want %d", v, journalVersion)
+	}
+
+	var (
+		buf      [journalRecordSize + bucketPacketSize]byte
+		upserts  int
+		deletes  int
+		replayed = int64(journalHeaderSize)
+		torn     error // Why the tail of the journal is discarded, if it's torn.
+		err      error
+	)
+
+	for {
+		_, err = io.ReadFull(br, buf[:journalRecordSize])
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			torn = err
+			break
+		} else if err != nil {
+			return err
+		}
+
+		size := int(binary.BigEndian.Uint16(buf[13:]))
+		if size > bucketPacketSize {
+			return fmt.Errorf("record at offset %d: size %d is too large", replayed, size)
+		}
+
+		record := buf[:journalRecordSize+size]
+		if _, err = io.ReadFull(br, record[journalRecordSize:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			torn = io.ErrUnexpectedEOF
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// Only the last record can be torn by a crash while appending it, so a
+		// mismatch anywhere else is corruption that truncating would make worse.
+		if crc32.Checksum(record[4:], crc32cTable) != binary.BigEndian.Uint32(record) {
+			if _, err = br.Peek(1); err == io.EOF {
+				torn = errors.New("record checksum mismatch")
+				break
+			} else if err != nil {
+				return err
+			}
+			return fmt.Errorf("record at offset %d: checksum mismatch", replayed)
+		}
+
+		data := record[journalRecordSize:]
+		switch record[4] {
+		case journalUpsert:
+			b := Bucket{}
+			if ns := int64(binary.BigEndian.Uint64(record[5:])); ns != 0 {
+				b.created = time.Unix(0, ns)
+			}
+			if err = b.UnmarshalBinary(data); err != nil {
+				return fmt.Errorf("record at offset %d: %v", replayed, err)
+			}
+			j.repo.UpsertBucket(ctx, &b)
+			upserts++
+		case journalDelete:
+			j.repo.DeleteBucket(ctx, string(data))
+			deletes++
+		default:
+			return fmt.Errorf("record at offset %d: unknown kind %d", replayed, record[4])
+		}
+
+		replayed += int64(len(record))
+	}
+
+	if torn != nil {
+		j.log.Error("truncating torn journal tail",
+			zap.String("file", j.filename),
+			zap.Int64("offset", replayed),
+			zap.Error(torn),
+		)
+	}
+
+	j.log.Info("replayed journal",
+		zap.String("file", j.filename),
+		zap.Int("upserts", upserts),
+		zap.Int("deletes", deletes),
+	)
+
+	// Drop whatever follows the last valid record so that appends start right after it.
+	if err = j.file.Truncate(replayed); err != nil {
+		return err
+	}
+
+	if _, err = j.file.Seek(replayed, io.SeekStart); err != nil {
+		return err
+	}
+
+	j.size = replayed
+	return nil
+}
+
+// writeHeader writes the journal header to the empty journal.
+func (j *JournalRepo) writeHeader() error {
+	if err := writeJournalHeader(j.file); err != nil {
+		return err
+	}
+
+	j.size = journalHeaderSize
+	return j.file.Sync()
+}
+
+// GetBucket gets a Bucket by its name from the wrapped Repo, creating it if it
+// doesn't exist. New Buckets aren't journaled until they're upserted.
+func (j *JournalRepo) GetBucket(ctx context.Context, name string) (*Bucket, bool) {
+	return j.repo.GetBucket(ctx, name)
+}
+
+// LookupBucket gets a Bucket by its name from the wrapped Repo, without creating it
+// if it doesn't exist.
+func (j *JournalRepo) LookupBucket(ctx context.Context, name string) (*Bucket, bool) {
+	return j.repo.LookupBucket(ctx, name)
+}
+
+// UpsertBucket upserts the given Bucket in the wrapped Repo and journals its
+// resulting state.
+func (j *JournalRepo) UpsertBucket(ctx context.Context, b *Bucket) (*Bucket, bool) {
+	upserted, ok := j.repo.UpsertBucket(ctx, b)
+
+	record, err := encodeJournalUpsert(upserted)
+	if err == nil {
+		err = j.append(record)
+	}
+
+	if err != nil {
+		j.log.Error("journaling upsert", zap.Object("bucket", upserted), zap.Error(err))
+	}
+
+	return upserted, ok
+}
+
+// DeleteBucket deletes the Bucket with the given name from the wrapped Repo and
+// journals its deletion.
+func (j *JournalRepo) DeleteBucket(ctx context.Context, name string) bool {
+	deleted := j.repo.DeleteBucket(ctx, name)
+	if deleted {
+		record := encodeJournalRecord(journalDelete, time.Time{}, []byte(name))
+		if err := j.append(record); err != nil {
+			j.log.Error("journaling delete", zap.String("bucket", name), zap.Error(err))
+		}
+	}
+	return deleted
+}
+
+// ListBuckets lists Buckets from the wrapped Repo.
+func (j *JournalRepo) ListBuckets(ctx context.Context, opts ListOptions) []*Bucket {
+	return j.repo.ListBuckets(ctx, opts)
+}
+
+func (j *JournalRepo) allBuckets(ctx context.Context) []*Bucket {
+	return allBuckets(ctx, j.repo)
+}
+
+// append appends a record to the journal, syncing it if the SyncPolicy is SyncAlways.
+func (j *JournalRepo) append(record []byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	n, err := j.file.Write(record)
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if j.opts.Sync == SyncAlways {
+		return j.file.Sync()
+	}
+
+	return nil
+}
+
+// Sync flushes the journal to stable storage.
+func (j *JournalRepo) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Sync()
+}
+
+// Compact atomically replaces the journal with one that has a single upsert with
+// the current state of each Bucket in the wrapped Repo. Writes to the journal
+// block until it's done.
+func (j *JournalRepo) Compact(ctx context.Context) (err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := createTemp(j.filename)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	if err = writeJournalHeader(bw); err != nil {
+		return err
+	}
+
+	// Mutations of the listed Buckets which are yet to be journaled are blocked on
+	// the lock, so they're appended to the compacted journal.
+	size := int64(journalHeaderSize)
+	for _, b := range allBuckets(ctx, j.repo) {
+		if b.IsZero() {
+			continue
+		}
+
+		var record []byte
+		if record, err = encodeJournalUpsert(b); err != nil {
+			return err
+		}
+
+		var n int
+		n, err = bw.Write(record)
+		if size += int64(n); err != nil {
+			return err
+		}
+	}
+
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	if err = renameSync(f.Name(), j.filename); err != nil {
+		return err
+	}
+
+	j.log.Debug("compacted journal",
+		zap.String("file", j.filename),
+		zap.Int64("before", j.size),
+		zap.Int64("after", size),
+	)
+
+	// The old journal was replaced, so there's nothing to do if closing it fails.
+	j.file.Close()
+	j.file, j.size = f, size
+
+	return nil
+}
+
+// Run fsyncs the journal every SyncPeriod with SyncPeriodic, and compacts it every
+// CompactPeriod if set, until the context is done. Failures are logged.
+func (j *JournalRepo) Run(ctx context.Context) error {
+	var syncs, compactions <-chan time.Time
+	if j.opts.Sync == SyncPeriodic {
+		ticker := time.NewTicker(j.opts.SyncPeriod)
+		defer ticker.Stop()
+		syncs = ticker.C
+	}
+
+	if j.opts.CompactPeriod > 0 {
+		ticker := time.NewTicker(j.opts.CompactPeriod)
+		defer ticker.Stop()
+		compactions = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-syncs:
+			if err := j.Sync(); err != nil {
+				j.log.Error("syncing journal", zap.String("file", j.filename), zap.Error(err))
+			}
+		case <-compactions:
+			if err := j.Compact(ctx); err != nil {
+				j.log.Error("compacting journal", zap.String("file", j.filename), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Close syncs and closes the journal.
+func (j *JournalRepo) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return err
+	}
+
+	return j.file.Close()
+}
+
+// Size returns the size of the journal in bytes.
+func (j *JournalRepo) Size() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.size
+}
+
+func (j *JournalRepo) writeMetrics(w io.Writer) {
+	writeHeader(w, "patrol_journal_bytes", "Size of the Bucket journal in bytes.", "gauge")
+	writeSample(w, "patrol_journal_bytes", "", float64(j.Size()))
+	if m, ok := j.repo.(metricsWriter); ok {
+		m.writeMetrics(w)
+	}
+}
+
+// writeJournalHeader writes the header of a journal to w.
+func writeJournalHeader(w io.Writer) error {
+	var header [journalHeaderSize]byte
+	copy(header[:], journalMagic[:])
+	binary.BigEndian.PutUint32(header[4:], journalVersion)
+	_, err := w.Write(header[:])
+	return err
+}
+
+// encodeJournalUpsert returns the journal record of an upsert of the given Bucket.
+func encodeJournalUpsert(b *Bucket) ([]byte, error) {
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.RLock()
+	created := b.created
+	b.mu.RUnlock()
+
+	return encodeJournalRecord(journalUpsert, created, data), nil
+}
+
+// encodeJournalRecord returns a journal record of the given kind.
+func encodeJournalRecord(kind byte, created time.Time, data []byte) []byte {
+	record := make([]byte, journalRecordSize+len(data))
+	record[4] = kind
+	if !created.IsZero() {
+		binary.BigEndian.PutUint64(record[5:], uint64(created.UnixNano()))
+	}
+	binary.BigEndian.PutUint16(record[13:], uint16(len(data)))
+	copy(record[journalRecordSize:], data)
+	binary.BigEndian.PutUint32(record, crc32.Checksum(record[4:], crc32cTable))
+	return record
+}
@@ -0,0 +1,322 @@
+package patrol
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestJournalRepo(t *testing.T) {
+	filename, cleanup := tempJournal(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Now()
+	rate := Rate{Freq: 10, Per: time.Hour}
+
+	j := openJournal(t, filename, NewLocalRepo(time.Now))
+	for _, name := range []string{"foo", "foo", "bar", "baz"} {
+		b, _ := j.GetBucket(ctx, name)
+		b.Take(now, rate, 1)
+		j.UpsertBucket(ctx, b)
+	}
+
+	if !j.DeleteBucket(ctx, "baz") {
+		t.Fatal("baz wasn't deleted")
+	}
+
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	local := NewLocalRepo(time.Now)
+	j = openJournal(t, filename, local)
+	defer j.Close()
+
+	for name, taken := range map[string]float64{"foo": 2, "bar": 1} {
+		if b, ok := local.LookupBucket(ctx, name); !ok || b.taken != taken {
+			t.Errorf("%s: have %v, want %v taken", name, b, taken)
+		}
+	}
+
+	if b, ok := local.LookupBucket(ctx, "baz"); ok {
+		t.Errorf("baz: have %v, want deleted", b)
+	}
+}
+
+func TestJournalRepo_TornTail(t *testing.T) {
+	filename, cleanup := tempJournal(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	j := openJournal(t, filename, NewLocalRepo(time.Now))
+	for _, name := range []string{"foo", "bar"} {
+		j.UpsertBucket(ctx, &Bucket{name: name, taken: 1})
+	}
+	size := j.Size()
+	j.Close()
+
+	// Cut the last record in half, as a crash while appending it would.
+	if err := os.Truncate(filename, size-10); err != nil {
+		t.Fatal(err)
+	}
+
+	local := NewLocalRepo(time.Now)
+	j = openJournal(t, filename, local)
+	if _, ok := local.LookupBucket(ctx, "foo"); !ok {
+		t.Error("foo wasn't replayed")
+	}
+	if _, ok := local.LookupBucket(ctx, "bar"); ok {
+		t.Error("torn bar record was replayed")
+	}
+
+	// Appends continue after the last valid record.
+	j.UpsertBucket(ctx, &Bucket{name: "baz", taken: 1})
+	j.Close()
+
+	local = NewLocalRepo(time.Now)
+	j = openJournal(t, filename, local)
+	defer j.Close()
+
+	if n := local.Len(); n != 2 {
+		t.Errorf("have %d buckets, want foo and baz", n)
+	}
+}
+
+func TestJournalRepo_Corrupted(t *testing.T) {
+	filename, cleanup := tempJournal(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	j := openJournal(t, filename, NewLocalRepo(time.Now))
+	for _, name := range []string{"foo", "bar"} {
+		j.UpsertBucket(ctx, &Bucket{name: name, taken: 1})
+	}
+	j.Close()
+
+	journal, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := journalRecordSize + bucketFixedSize + len("foo")
+	for _, tc := range []struct {
+		name    string
+		data    func([]byte) []byte
+		err     string
+		buckets int
+	}{
+		{
+			name:    "last record",
+			data:    func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b },
+			buckets: 1,
+		},
+		{
+			name: "earlier record",
+			data: func(b []byte) []byte { b[journalHeaderSize+record-1] ^= 0xff; return b },
+			err:  "record at offset 8: checksum mismatch",
+		},
+		{
+			name: "unknown kind",
+			data: func(b []byte) []byte {
+				return append(b, encodeJournalRecord(9, time.Time{}, []byte("foo"))...)
+			},
+			err:     "unknown kind 9",
+			buckets: 2, // Replayed before the error.
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.data(append([]byte(nil), journal...))
+			if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			local := NewLocalRepo(time.Now)
+			j, err := NewJournalRepo(zap.NewNop(), local, filename, JournalOptions{Sync: SyncNever})
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				j.Close()
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("have error %v, want %q", err, tc.err)
+			}
+
+			if n := local.Len(); n != tc.buckets {
+				t.Errorf("have %d buckets replayed, want %d", n, tc.buckets)
+			}
+
+			// Only a torn tail is truncated.
+			want := int64(len(data))
+			if tc.err == "" {
+				want = int64(journalHeaderSize + record)
+			}
+			if fi, err := os.Stat(filename); err != nil || fi.Size() != want {
+				t.Errorf("have file %v (%v), want size %d", fi, err, want)
+			}
+		})
+	}
+}
+
+func TestJournalRepo_Compact(t *testing.T) {
+	filename, cleanup := tempJournal(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	j := openJournal(t, filename, NewLocalRepo(time.Now))
+	for i := 0; i < 100; i++ {
+		j.UpsertBucket(ctx, &Bucket{name: "foo", taken: float64(i)})
+	}
+	j.UpsertBucket(ctx, &Bucket{name: "bar", taken: 1})
+	j.DeleteBucket(ctx, "bar")
+
+	if err := os.Chmod(filename, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat(filename); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("have file %v (%v), want the permissions of the compacted journal", fi, err)
+	}
+
+	// The header and a single record of foo.
+	want := int64(journalHeaderSize + journalRecordSize + bucketFixedSize + len("foo"))
+	if have := j.Size(); have != want {
+		t.Errorf("have size %d, want %d", have, want)
+	}
+
+	if fi, err := os.Stat(filename); err != nil || fi.Size() != want {
+		t.Errorf("have file %v (%v), want size %d", fi, err, want)
+	}
+
+	// Appends go to the compacted journal.
+	j.UpsertBucket(ctx, &Bucket{name: "foo", taken: 100})
+	j.Close()
+
+	local := NewLocalRepo(time.Now)
+	j = openJournal(t, filename, local)
+	defer j.Close()
+
+	if b, ok := local.LookupBucket(ctx, "foo"); !ok || b.taken != 100 {
+		t.Errorf("foo: have %v, want 100 taken", b)
+	}
+
+	if n := local.Len(); n != 1 {
+		t.Errorf("have %d buckets, want only foo", n)
+	}
+}
+
+func TestJournalRepo_Version(t *testing.T) {
+	filename, cleanup := tempJournal(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(filename, []byte("PTRJ\x00\x00\x00\x02"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewJournalRepo(zap.NewNop(), NewLocalRepo(time.Now), filename, JournalOptions{})
+	if want := "journal version 2 isn't supported, want 1"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("have error %v, want %q", err, want)
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, p := range []SyncPolicy{SyncPeriodic, SyncAlways, SyncNever} {
+		if have, err := ParseSyncPolicy(p.String()); err != nil || have != p {
+			t.Errorf("ParseSyncPolicy(%q): have %v, %v, want %v", p, have, err, p)
+		}
+	}
+
+	if p := (JournalOptions{}).Sync; p != SyncPeriodic {
+		t.Errorf("have zero sync policy %v, want %v", p, SyncPeriodic)
+	}
+
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("ParseSyncPolicy(\"sometimes\"): want error")
+	}
+}
+
+func BenchmarkJournalRepo_Take(b *testing.B) {
+	names := make([]string, 1<<16)
+	for i := range names {
+		names[i] = strconv.Itoa(i)
+	}
+
+	for _, bc := range []struct {
+		name string
+		sync SyncPolicy
+	}{
+		{"LocalRepo", 0},
+		{"JournalRepo/sync=never", SyncNever},
+		{"JournalRepo/sync=periodic", SyncPeriodic},
+		{"JournalRepo/sync=always", SyncAlways},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			ctx := context.Background()
+			var repo Repo = NewLocalRepo(time.Now)
+
+			if strings.HasPrefix(bc.name, "JournalRepo") {
+				filename, cleanup := tempJournal(b)
+				defer cleanup()
+
+				opts := JournalOptions{Sync: bc.sync}
+				j, err := NewJournalRepo(zap.NewNop(), repo, filename, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer j.Close()
+
+				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				go j.Run(ctx)
+
+				repo = j
+			}
+
+			rate := Rate{Freq: 1000, Per: time.Second}
+			seed := int64(0)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for pb.Next() {
+					bucket, _ := repo.GetBucket(ctx, names[rng.Intn(len(names))])
+					bucket.Take(time.Now(), rate, 1)
+					repo.UpsertBucket(ctx, bucket)
+				}
+			})
+		})
+	}
+}
+
+// tempJournal returns the name of a journal file in a new temporary directory,
+// and a function which removes it.
+func tempJournal(tb testing.TB) (string, func()) {
+	dir, err := ioutil.TempDir("", "patrol")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return filepath.Join(dir, "journal"), func() { os.RemoveAll(dir) }
+}
+
+func openJournal(t *testing.T, filename string, r Repo) *JournalRepo {
+	j, err := NewJournalRepo(zap.NewNop(), r, filename, JournalOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
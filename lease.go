@@ -0,0 +1,141 @@
+package patrol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Concurrency Buckets limit the number of in-flight requests rather than their rate.
+// Each request acquires a Lease which it releases when done. The Bucket counts the
+// leases acquired and released with two G-Counters, merged by taking the maximum of
+// each, so that the leases in flight are their difference. Like takes on token Buckets,
+// concurrent acquires on different nodes merge to the largest of them.
+//
+// Leases themselves are only known to the node which granted them, which expires them
+// after their TTL in case clients crash before releasing them. If that node dies, its
+// leases stay in flight on the other nodes until the Bucket is Reset. Expired
+// leases are released lazily, and replicated with the next update of the Bucket.
+
+// A Lease is a slot of a concurrency Bucket held by an in-flight request.
+type Lease struct {
+	// ID of the Lease, which releases it.
+	ID string
+	// Expires is the time at which the Lease is released if it wasn't before.
+	Expires time.Time
+}
+
+// leaseSet holds the leases granted by a node for a concurrency Bucket.
+type leaseSet struct {
+	// expires holds the expiry time of each lease by its ID.
+	expires map[string]time.Time
+	// last is the time of the last Acquire or Release.
+	last time.Time
+}
+
+// Acquire acquires a Lease on the Bucket at time now which expires after the given ttl,
+// if fewer than max leases are in flight. It returns the Lease, the number of leases in
+// flight afterwards and true on success.
+func (b *Bucket) Acquire(now time.Time, max uint64, ttl time.Duration) (lease Lease, inFlight uint64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expireLeases(now)
+	if inFlight = b.inFlight(); inFlight >= max {
+		return Lease{}, inFlight, false
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err) // The system's random number generator must not fail.
+	}
+
+	if b.leases == nil {
+		b.leases = &leaseSet{expires: make(map[string]time.Time)}
+	}
+
+	lease = Lease{ID: hex.EncodeToString(id[:]), Expires: now.Add(ttl)}
+	b.leases.expires[lease.ID] = lease.Expires
+	b.leases.last = now
+	b.acquired++
+
+	return lease, b.inFlight(), true
+}
+
+// Release releases the Lease with the given ID at time now. It returns false if the
+// Lease wasn't granted by this node or already expired.
+func (b *Bucket) Release(now time.Time, id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expireLeases(now)
+	if b.leases == nil {
+		return false
+	} else if _, ok := b.leases.expires[id]; !ok {
+		return false
+	}
+
+	delete(b.leases.expires, id)
+	b.leases.last = now
+	b.release()
+
+	return true
+}
+
+// InFlight returns the number of leases in flight at time now.
+func (b *Bucket) InFlight(now time.Time) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expireLeases(now)
+	return b.inFlight()
+}
+
+// inFlight returns the number of leases in flight. It must be called with the lock held.
+func (b *Bucket) inFlight() uint64 {
+	return uint64(b.acquired - b.released)
+}
+
+// release counts a released lease. Since merged acquires may be fewer than the ones that
+// happened, releases are capped at the acquires so that in flight leases never go negative.
+// It must be called with the write lock held.
+func (b *Bucket) release() {
+	if b.released++; b.released > b.acquired {
+		b.released = b.acquired
+	}
+}
+
+// expireLeases releases the leases granted by this node which expired at time now.
+// It must be called with the write lock held.
+func (b *Bucket) expireLeases(now time.Time) {
+	if b.leases == nil {
+		return
+	}
+
+	for id, expires := range b.leases.expires {
+		if !now.Before(expires) {
+			delete(b.leases.expires, id)
+			b.leases.last = now
+			b.release()
+		}
+	}
+}
+
+// leasesExpired implements Expired for concurrency Buckets, which releases the leases
+// that expired at time now. It returns true if all leases acquired in the cluster, as
+// merged from its counters, were released, and the Bucket hasn't been acquired from
+// nor released in this node for at least ttl.
+func (b *Bucket) leasesExpired(now time.Time, ttl time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.expireLeases(now); b.acquired != b.released {
+		return false
+	}
+
+	last := b.created
+	if b.leases != nil {
+		last = b.leases.last
+	}
+
+	return now.Sub(last) >= ttl
+}
@@ -0,0 +1,106 @@
+package patrol
+
+import (
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestBucket_LeaseMarshaling(t *testing.T) {
+	prop := func(name string, acquired, released float64) bool {
+		b := Bucket{name: name, algo: Concurrency, acquired: acquired, released: released}
+		data, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded := Bucket{tat: 1}
+		if err = decoded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+
+		return b == decoded
+	}
+
+	if err := quick.Check(prop, &quick.Config{MaxCount: 1e5}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBucket_Acquire(t *testing.T) {
+	now := time.Unix(1000, 0)
+	bucket := Bucket{algo: Concurrency, created: now}
+
+	a, inFlight, ok := bucket.Acquire(now, 2, time.Minute)
+	if !ok || inFlight != 1 || a.ID == "" || !a.Expires.Equal(now.Add(time.Minute)) {
+		t.Fatalf("first Acquire: have (%+v, %d, %t)", a, inFlight, ok)
+	}
+
+	b, inFlight, ok := bucket.Acquire(now, 2, time.Second)
+	if !ok || inFlight != 2 || b.ID == a.ID {
+		t.Fatalf("second Acquire: have (%+v, %d, %t)", b, inFlight, ok)
+	}
+
+	if _, inFlight, ok = bucket.Acquire(now, 2, time.Minute); ok || inFlight != 2 {
+		t.Fatalf("Acquire over max: have (%d, %t), want (2, false)", inFlight, ok)
+	}
+
+	if !bucket.Release(now, a.ID) || bucket.Release(now, a.ID) {
+		t.Fatal("want a lease to be released exactly once")
+	}
+
+	if have := bucket.InFlight(now.Add(time.Second)); have != 0 {
+		t.Errorf("have %d in flight after the lease TTL, want 0", have)
+	}
+
+	if bucket.Release(now.Add(time.Second), b.ID) {
+		t.Error("want expired lease to not be released")
+	}
+
+	if bucket.Expired(now.Add(time.Second), time.Minute) || !bucket.Expired(now.Add(time.Minute+time.Second), time.Minute) {
+		t.Error("want Bucket to expire a TTL after its last lease was released")
+	}
+}
+
+func TestBucket_LeasesExpired(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ttl := time.Minute
+
+	// Merged from a peer which holds a lease.
+	merged := &Bucket{algo: Concurrency, created: now}
+	merged.Merge(&Bucket{algo: Concurrency, acquired: 2, released: 1})
+	if merged.Expired(now.Add(2*ttl), ttl) {
+		t.Error("want Bucket with leases held in the cluster to not expire")
+	}
+
+	merged.Merge(&Bucket{algo: Concurrency, acquired: 2, released: 2})
+	if !merged.Expired(now.Add(2*ttl), ttl) {
+		t.Error("want Bucket with all leases released to expire")
+	}
+}
+
+func TestBucket_MergeLeases(t *testing.T) {
+	now := time.Unix(1000, 0)
+	a := Bucket{algo: Concurrency}
+	b := Bucket{algo: Concurrency}
+
+	// Concurrent acquires merge to the largest of them.
+	la, _, _ := a.Acquire(now, 10, time.Minute)
+	lb, _, _ := b.Acquire(now, 10, time.Minute)
+	a.Merge(&b)
+	b.Merge(&a)
+
+	a.Release(now, la.ID)
+	b.Merge(&a)
+	b.Release(now, lb.ID)
+	a.Merge(&b)
+
+	if have := a.InFlight(now); have != 0 {
+		t.Errorf("have %d in flight, want 0", have)
+	}
+
+	// Releases never exceed acquires, so the next acquire is counted.
+	if _, inFlight, _ := a.Acquire(now, 10, time.Minute); inFlight != 1 {
+		t.Errorf("have %d in flight, want 1", inFlight)
+	}
+}
@@ -0,0 +1,127 @@
+package patrol
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A metricsWriter writes its metrics in the Prometheus text exposition format.
+// Repos implement it to have their metrics exposed by the API.
+type metricsWriter interface {
+	writeMetrics(w io.Writer)
+}
+
+// A counter is a monotonically increasing value. It's safe for concurrent use.
+type counter struct{ v uint64 }
+
+func (c *counter) inc()         { atomic.AddUint64(&c.v, 1) }
+func (c *counter) load() uint64 { return atomic.LoadUint64(&c.v) }
+
+// A counterVec is a set of counters partitioned by the value of a single label.
+// It's safe for concurrent use.
+type counterVec struct {
+	label string
+	mu    sync.RWMutex
+	m     map[string]*counter
+}
+
+func newCounterVec(label string) *counterVec {
+	return &counterVec{label: label, m: map[string]*counter{}}
+}
+
+// with returns the counter for the given label value, creating it if needed.
+func (v *counterVec) with(value string) *counter {
+	v.mu.RLock()
+	c, ok := v.m[value]
+	v.mu.RUnlock()
+
+	if ok {
+		return c
+	}
+
+	v.mu.Lock()
+	if c, ok = v.m[value]; !ok {
+		c = &counter{}
+		v.m[value] = c
+	}
+	v.mu.Unlock()
+
+	return c
+}
+
+func (v *counterVec) write(w io.Writer, name, help string) {
+	v.mu.RLock()
+	values := make([]string, 0, len(v.m))
+	for value := range v.m {
+		values = append(values, value)
+	}
+	v.mu.RUnlock()
+
+	sort.Strings(values)
+
+	writeHeader(w, name, help, "counter")
+	for _, value := range values {
+		writeSample(w, name, labels(v.label, value), float64(v.with(value).load()))
+	}
+}
+
+// A histogram counts observations in cumulative buckets. It's safe for concurrent use.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // Non cumulative, one per bound plus +Inf.
+	sum    uint64   // Bits of a float64.
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	writeHeader(w, name, help, "histogram")
+
+	var count uint64
+	for i, bound := range h.bounds {
+		count += atomic.LoadUint64(&h.counts[i])
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		writeSample(w, name+"_bucket", labels("le", le), float64(count))
+	}
+	count += atomic.LoadUint64(&h.counts[len(h.bounds)])
+
+	writeSample(w, name+"_bucket", labels("le", "+Inf"), float64(count))
+	writeSample(w, name+"_sum", "", math.Float64frombits(atomic.LoadUint64(&h.sum)))
+	writeSample(w, name+"_count", "", float64(count))
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w io.Writer, name, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// labels formats the given label name and value pair.
+func labels(name, value string) string {
+	return "{" + name + `="` + labelValueEscaper.Replace(value) + `"}`
+}
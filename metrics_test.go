@@ -0,0 +1,39 @@
+package patrol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	var buf bytes.Buffer
+
+	h := newHistogram(.1, 1)
+	for _, v := range []float64{.05, .5, .5, 2} {
+		h.observe(v)
+	}
+	h.write(&buf, "latency_seconds", "Latency.")
+
+	c := newCounterVec("peer")
+	c.with("b").inc()
+	c.with("a\"").inc()
+	c.with("b").inc()
+	c.write(&buf, "packets_total", "Packets.")
+
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 3.05
+latency_seconds_count 4
+# HELP packets_total Packets.
+# TYPE packets_total counter
+packets_total{peer="a\""} 1
+packets_total{peer="b"} 2
+`
+
+	if have := buf.String(); have != want {
+		t.Errorf("have:\n%s\nwant:\n%s", have, want)
+	}
+}
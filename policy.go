@@ -0,0 +1,330 @@
+package patrol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A Policy sets the limits of the Buckets whose names match it, for take requests
+// which don't specify them. Exactly one of Prefix, Glob or Regex is set.
+type Policy struct {
+	// Prefix matches names that start with it.
+	Prefix string
+	// Glob matches names with the syntax of path.Match (e.g. "key:*:read").
+	Glob string
+	// Regex matches names with the syntax of the regexp package. It isn't anchored
+	// unless it starts with ^ and ends with $.
+	Regex string
+
+	Rate      Rate
+	Algorithm Algorithm
+	// Quota of CalendarQuota Policies, which have no Rate.
+	Quota Quota
+
+	re *regexp.Regexp
+}
+
+// Matches returns true if the given Bucket name matches the Policy. Policies with
+// a Regex match no names until compiled by ParsePolicies or API.SetPolicies.
+func (p *Policy) Matches(name string) bool {
+	switch {
+	case p.Regex != "":
+		return p.re != nil && p.re.MatchString(name)
+	case p.Glob != "":
+		ok, _ := path.Match(p.Glob, name)
+		return ok
+	default:
+		return strings.HasPrefix(name, p.Prefix)
+	}
+}
+
+// String implements the Stringer interface, describing how the Policy matches names.
+func (p *Policy) String() string {
+	switch {
+	case p.Regex != "":
+		return fmt.Sprintf("regex %q", p.Regex)
+	case p.Glob != "":
+		return fmt.Sprintf("glob %q", p.Glob)
+	default:
+		return fmt.Sprintf("prefix %q", p.Prefix)
+	}
+}
+
+// Limits returns a description of the limits set by the Policy.
+func (p *Policy) Limits() string {
+	if p.Algorithm == CalendarQuota {
+		return p.Algorithm.String() + " " + p.Quota.String()
+	}
+	return p.Algorithm.String() + " " + p.Rate.String()
+}
+
+// Policies is a list of Policies, of which the first one that matches a Bucket applies.
+type Policies []Policy
+
+// Match returns the first Policy that matches the given Bucket name, if any.
+func (ps Policies) Match(name string) (*Policy, bool) {
+	for i := range ps {
+		if ps[i].Matches(name) {
+			return &ps[i], true
+		}
+	}
+	return nil, false
+}
+
+// policyFile is the JSON format of a policy file.
+type policyFile struct {
+	Policies []struct {
+		Prefix *string `json:"prefix"`
+		Glob   string  `json:"glob"`
+		Regex  string  `json:"regex"`
+		Rate   string  `json:"rate"`
+		Burst  int     `json:"burst"`
+		Algo   string  `json:"algo"`
+		Quota  string  `json:"quota"`
+	} `json:"policies"`
+}
+
+// LoadPolicies loads Policies from the JSON file at the given path with ParsePolicies.
+func LoadPolicies(filename string) (Policies, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ps, err := ParsePolicies(f)
+	if err != nil {
+		return nil, fmt.Errorf("policy file %s: %v", filename, err)
+	}
+
+	return ps, nil
+}
+
+// ParsePolicies parses and validates Policies from JSON in the following format:
+//
+//	{"policies": [
+//	  {"prefix": "ip:", "rate": "100:1m", "burst": 10},
+//	  {"glob": "key:*:write", "rate": "10:1s", "algo": "gcra"},
+//	  {"regex": "^tenant:[0-9]+$", "quota": "10000:month"}
+//	]}
+//
+// It returns an error for Policies which match the same names as an earlier one,
+// and would never apply: identical patterns, or prefixes, globs and anchored regexes
+// whose literal prefix starts with an earlier prefix.
+func ParsePolicies(r io.Reader) (Policies, error) {
+	var file policyFile
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, err
+	}
+
+	ps := make(Policies, 0, len(file.Policies))
+	for i, raw := range file.Policies {
+		var (
+			p        Policy
+			err      error
+			matchers int
+		)
+
+		if raw.Prefix != nil {
+			p.Prefix = *raw.Prefix
+			matchers++
+		}
+
+		if raw.Glob != "" {
+			p.Glob = raw.Glob
+			matchers++
+		}
+
+		if raw.Regex != "" {
+			p.Regex = raw.Regex
+			matchers++
+		}
+
+		if matchers != 1 {
+			return nil, fmt.Errorf("policy %d: must have exactly one of prefix, glob or regex", i)
+		}
+
+		if err = p.compile(); err != nil {
+			return nil, fmt.Errorf("policy %d: %v", i, err)
+		}
+
+		if err = p.parseLimits(raw.Rate, raw.Burst, raw.Algo, raw.Quota); err != nil {
+			return nil, fmt.Errorf("policy %d (%s): %v", i, &p, err)
+		}
+
+		if err = ps.checkShadowed(&p, i); err != nil {
+			return nil, err
+		}
+
+		ps = append(ps, p)
+	}
+
+	return ps, nil
+}
+
+// compilePolicies returns a copy of the given Policies, as built by hand, validated and
+// compiled like those returned by ParsePolicies.
+func compilePolicies(ps Policies) (Policies, error) {
+	compiled := make(Policies, 0, len(ps))
+	for i := range ps {
+		p := ps[i]
+		if p.Prefix != "" && (p.Glob != "" || p.Regex != "") || p.Glob != "" && p.Regex != "" {
+			return nil, fmt.Errorf("policy %d: must have exactly one of prefix, glob or regex", i)
+		}
+
+		if err := p.compile(); err != nil {
+			return nil, fmt.Errorf("policy %d: %v", i, err)
+		}
+
+		if err := compiled.checkShadowed(&p, i); err != nil {
+			return nil, err
+		}
+
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+// compile validates the Glob of the Policy and compiles its Regex.
+func (p *Policy) compile() (err error) {
+	if p.Glob != "" {
+		if _, err = path.Match(p.Glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %v", p.Glob, err)
+		}
+	}
+
+	if p.Regex != "" {
+		if p.re, err = regexp.Compile(p.Regex); err != nil {
+			return fmt.Errorf("invalid regex %q: %v", p.Regex, err)
+		}
+	}
+
+	return nil
+}
+
+// checkShadowed returns an error if any of the Policies matches all names that the
+// given later Policy, at index i, matches.
+func (ps Policies) checkShadowed(later *Policy, i int) error {
+	for j := range ps {
+		if p := &ps[j]; p.shadows(later) {
+			return fmt.Errorf("policy %d (%s) conflicts with policy %d (%s) which matches the same names first", i, later, j, p)
+		}
+	}
+	return nil
+}
+
+// parseLimits parses and validates the limits of the Policy.
+func (p *Policy) parseLimits(rate string, burst int, algo, quota string) (err error) {
+	if algo != "" {
+		if p.Algorithm, err = ParseAlgorithm(algo); err != nil {
+			return err
+		} else if p.Algorithm == Concurrency {
+			return errors.New("concurrency buckets are acquired, not taken from")
+		}
+	} else if quota != "" {
+		p.Algorithm = CalendarQuota
+	}
+
+	if p.Algorithm == CalendarQuota {
+		if rate != "" || burst != 0 {
+			return errors.New("quota policies can't have a rate or burst")
+		} else if quota == "" {
+			return errors.New("quota is required by the quota algorithm")
+		}
+
+		if p.Quota, err = ParseQuota(quota); err != nil {
+			return fmt.Errorf("invalid quota %q: %v", quota, err)
+		}
+
+		return nil
+	}
+
+	if quota != "" {
+		return fmt.Errorf("quota can't be used with the %s algorithm", p.Algorithm)
+	} else if rate == "" {
+		return errors.New("rate is required")
+	}
+
+	if p.Rate, err = ParseRate(rate); err != nil {
+		return fmt.Errorf("invalid rate %q: %v", rate, err)
+	}
+
+	switch {
+	case burst < 0:
+		return fmt.Errorf("invalid burst %d: must be positive", burst)
+	case burst > 0:
+		p.Rate.Burst = burst
+	}
+
+	return nil
+}
+
+// shadows returns true if the Policy matches all names that the given later Policy
+// matches, so that it would never apply. It must be called with compiled Policies.
+func (p *Policy) shadows(later *Policy) bool {
+	switch {
+	case p.Prefix == "" && p.Glob == "" && p.Regex == "": // Matches everything.
+		return true
+	case p.Regex != "" || p.Glob != "":
+		return p.Regex == later.Regex && p.Glob == later.Glob
+	default:
+		return strings.HasPrefix(later.literalPrefix(), p.Prefix)
+	}
+}
+
+// literalPrefix returns the literal prefix of all the names that the Policy matches.
+// It must be called with a compiled Policy.
+func (p *Policy) literalPrefix() string {
+	switch {
+	case p.Regex != "":
+		if !strings.HasPrefix(p.Regex, "^") { // Unanchored regexes can match any name.
+			return ""
+		}
+		prefix, _ := p.re.LiteralPrefix()
+		return prefix
+	case p.Glob != "":
+		if i := strings.IndexAny(p.Glob, `*?[\`); i >= 0 {
+			return p.Glob[:i]
+		}
+		return p.Glob
+	default:
+		return p.Prefix
+	}
+}
+
+// diffPolicies returns the differences between the old and new Policies, one per line,
+// prefixed with "+" for added, "-" for removed and "~" for changed Policies.
+func diffPolicies(old, new Policies) (diff []string) {
+	index := make(map[string]*Policy, len(old))
+	for i := range old {
+		index[old[i].String()] = &old[i]
+	}
+
+	for i := range new {
+		p := &new[i]
+		o, ok := index[p.String()]
+		switch {
+		case !ok:
+			diff = append(diff, fmt.Sprintf("+ %s: %s", p, p.Limits()))
+		case o.Limits() != p.Limits():
+			diff = append(diff, fmt.Sprintf("~ %s: %s (was %s)", p, p.Limits(), o.Limits()))
+		}
+		delete(index, p.String())
+	}
+
+	for i := range old {
+		if p := &old[i]; index[p.String()] != nil {
+			diff = append(diff, fmt.Sprintf("- %s: %s", p, p.Limits()))
+		}
+	}
+
+	return diff
+}
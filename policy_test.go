@@ -0,0 +1,161 @@
+package patrol
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePolicies(t *testing.T) {
+	ps, err := ParsePolicies(strings.NewReader(`{"policies": [
+		{"prefix": "ip:10.", "rate": "1000:1m"},
+		{"prefix": "ip:", "rate": "100:1m", "burst": 10},
+		{"glob": "key:*:write", "rate": "10:1s", "algo": "gcra"},
+		{"regex": "^tenant:[0-9]+$", "quota": "10000:month"},
+		{"prefix": "", "rate": "1:1s"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		limits string
+	}{
+		{name: "ip:10.0.0.1", limits: "token_bucket 1000:1m0s"},
+		{name: "ip:1.2.3.4", limits: "token_bucket 100:1m0s:10"},
+		{name: "key:abc:write", limits: "gcra 10:1s"},
+		{name: "tenant:42", limits: "quota 10000:month"},
+		{name: "tenant:abc", limits: "token_bucket 1:1s"},
+	} {
+		p, ok := ps.Match(tc.name)
+		if !ok {
+			t.Errorf("%q: no policy matched", tc.name)
+		} else if have := p.Limits(); have != tc.limits {
+			t.Errorf("%q: have limits %q, want %q", tc.name, have, tc.limits)
+		}
+	}
+}
+
+func TestParsePolicies_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		policies string
+		err      string
+	}{
+		{
+			policies: `{"prefix": "ip:", "rate": "1:1s"}, {"prefix": "ip:10.", "rate": "2:1s"}`,
+			err:      `policy 1 (prefix "ip:10.") conflicts with policy 0 (prefix "ip:") which matches the same names first`,
+		},
+		{
+			policies: `{"glob": "a*", "rate": "1:1s"}, {"glob": "a*", "rate": "2:1s"}`,
+			err:      `policy 1 (glob "a*") conflicts with policy 0 (glob "a*") which matches the same names first`,
+		},
+		{
+			policies: `{"prefix": "", "rate": "1:1s"}, {"regex": "a", "rate": "2:1s"}`,
+			err:      `policy 1 (regex "a") conflicts with policy 0 (prefix "") which matches the same names first`,
+		},
+		{
+			policies: `{"prefix": "ip:", "rate": "1:1s"}, {"glob": "ip:10.*", "rate": "2:1s"}`,
+			err:      `policy 1 (glob "ip:10.*") conflicts with policy 0 (prefix "ip:") which matches the same names first`,
+		},
+		{
+			policies: `{"prefix": "ip:", "rate": "1:1s"}, {"regex": "^ip:10\\.[0-9]+$", "rate": "2:1s"}`,
+			err:      `policy 1 (regex "^ip:10\\.[0-9]+$") conflicts with policy 0 (prefix "ip:") which matches the same names first`,
+		},
+		{
+			policies: `{"prefix": "a", "glob": "a*", "rate": "1:1s"}`,
+			err:      `policy 0: must have exactly one of prefix, glob or regex`,
+		},
+		{
+			policies: `{"rate": "1:1s"}`,
+			err:      `policy 0: must have exactly one of prefix, glob or regex`,
+		},
+		{
+			policies: `{"regex": "(", "rate": "1:1s"}`,
+			err:      "policy 0: invalid regex \"(\": error parsing regexp: missing closing ): `(`",
+		},
+		{
+			policies: `{"glob": "[", "rate": "1:1s"}`,
+			err:      `policy 0: invalid glob "[": syntax error in pattern`,
+		},
+		{
+			policies: `{"prefix": "a"}`,
+			err:      `policy 0 (prefix "a"): rate is required`,
+		},
+		{
+			policies: `{"prefix": "a", "rate": "1:1s", "quota": "1:day"}`,
+			err:      `policy 0 (prefix "a"): quota policies can't have a rate or burst`,
+		},
+		{
+			policies: `{"prefix": "a", "algo": "concurrency"}`,
+			err:      `policy 0 (prefix "a"): concurrency buckets are acquired, not taken from`,
+		},
+		{
+			policies: `{"prefix": "a", "rate": "1:1s", "bucket": "b"}`,
+			err:      `json: unknown field "bucket"`,
+		},
+	} {
+		_, err := ParsePolicies(strings.NewReader(`{"policies": [` + tc.policies + `]}`))
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("%s\nhave error: %v\nwant error: %s", tc.policies, err, tc.err)
+		}
+	}
+}
+
+func TestCompilePolicies(t *testing.T) {
+	rate := Rate{Freq: 1, Per: time.Second}
+	ps, err := compilePolicies(Policies{
+		{Prefix: "ip:", Rate: rate},
+		{Regex: "ip:", Rate: rate}, // Unanchored, so it also matches other names.
+		{Regex: "^key:[0-9]+$", Rate: rate},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, ok := ps.Match("key:42"); !ok || p.Regex != "^key:[0-9]+$" {
+		t.Errorf("have %v, want the compiled regex to match", p)
+	}
+
+	if p, ok := ps.Match("tenant:1"); ok {
+		t.Errorf("have %v, want no match", p)
+	}
+
+	for _, invalid := range []Policies{
+		{{Regex: "(", Rate: rate}},
+		{{Prefix: "a", Glob: "a*", Rate: rate}},
+		{{Prefix: "ip:", Rate: rate}, {Glob: "ip:*", Rate: rate}},
+	} {
+		if _, err := compilePolicies(invalid); err == nil {
+			t.Errorf("%v: want error", invalid)
+		}
+	}
+}
+
+func TestDiffPolicies(t *testing.T) {
+	parse := func(policies string) Policies {
+		ps, err := ParsePolicies(strings.NewReader(`{"policies": [` + policies + `]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ps
+	}
+
+	old := parse(`{"prefix": "ip:", "rate": "100:1m"}, {"glob": "key:*", "rate": "10:1s"}`)
+	new := parse(`{"prefix": "ip:", "rate": "50:1m"}, {"regex": "^tenant:", "quota": "5:day"}`)
+
+	have := strings.Join(diffPolicies(old, new), "\n")
+	want := strings.Join([]string{
+		`~ prefix "ip:": token_bucket 50:1m0s (was token_bucket 100:1m0s)`,
+		`+ regex "^tenant:": quota 5:day`,
+		`- glob "key:*": token_bucket 10:1s`,
+	}, "\n")
+
+	if have != want {
+		t.Errorf("have diff:\n%s\nwant diff:\n%s", have, want)
+	}
+
+	if diff := diffPolicies(new, new); len(diff) != 0 {
+		t.Errorf("have diff %q between the same policies", diff)
+	}
+}
@@ -0,0 +1,212 @@
+package patrol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Period is a calendar period over which a Quota is counted.
+type Period uint8
+
+// Supported Periods.
+const (
+	Daily Period = iota
+	Weekly
+	Monthly
+)
+
+var periodNames = [...]string{
+	Daily:   "day",
+	Weekly:  "week",
+	Monthly: "month",
+}
+
+// String implements the Stringer interface.
+func (p Period) String() string {
+	if int(p) < len(periodNames) {
+		return periodNames[p]
+	}
+	return fmt.Sprintf("Period(%d)", p)
+}
+
+// Quota defines the maximum number of events in each calendar Period, which resets
+// at its start in the Quota's Location (e.g. at midnight or on the 1st of the month).
+// Weeks start on Monday.
+type Quota struct {
+	Limit  uint64
+	Period Period
+	// Location of the calendar, which defaults to UTC when nil.
+	Location *time.Location
+}
+
+// ParseQuota returns a new Quota parsed from the given string in the
+// "limit:period[:location]" format (i.e. 10000:month or 500:day:Europe/Berlin).
+func ParseQuota(v string) (q Quota, err error) {
+	ps := strings.SplitN(v, ":", 3)
+	if len(ps) < 2 {
+		return Quota{}, fmt.Errorf("format %q doesn't match the \"limit:period\" format (i.e. 10000:month)", v)
+	}
+
+	if q.Limit, err = strconv.ParseUint(ps[0], 10, 64); err != nil {
+		return q, err
+	}
+
+	found := false
+	for p, name := range periodNames {
+		if found = name == ps[1]; found {
+			q.Period = Period(p)
+			break
+		}
+	}
+
+	if !found {
+		return q, fmt.Errorf("unknown period %q", ps[1])
+	}
+
+	if len(ps) == 3 {
+		if q.Location, err = time.LoadLocation(ps[2]); err != nil {
+			return q, err
+		}
+	}
+
+	return q, nil
+}
+
+// String implements the Stringer interface.
+func (q Quota) String() string {
+	s := strconv.FormatUint(q.Limit, 10) + ":" + q.Period.String()
+	if q.Location != nil && q.Location != time.UTC {
+		s += ":" + q.Location.String()
+	}
+	return s
+}
+
+// location returns the Location of the Quota's calendar.
+func (q Quota) location() *time.Location {
+	if q.Location == nil {
+		return time.UTC
+	}
+	return q.Location
+}
+
+// period returns the number of the Period which contains time now.
+func (q Quota) period(now time.Time) int64 {
+	y, m, d := now.In(q.location()).Date()
+	if q.Period == Monthly {
+		return int64(y)*12 + int64(m) - 1
+	}
+
+	days := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+	if q.Period == Weekly {
+		return (days + 3) / 7 // The Unix epoch was on a Thursday.
+	}
+
+	return days
+}
+
+// Reset returns the start of the Period after the one which contains time now.
+func (q Quota) Reset(now time.Time) time.Time {
+	loc := q.location()
+	t := now.In(loc)
+	y, m, d := t.Date()
+
+	switch q.Period {
+	case Monthly:
+		return time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+	case Weekly:
+		return time.Date(y, m, d+7-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+	}
+}
+
+// Quota Buckets count the tokens taken in the current and previous calendar Periods,
+// numbered since the Unix epoch, in the window fields of window based Buckets, which
+// merge the same way.
+//
+// Since Periods are absolute, they depend on node clocks. A node whose clock is ahead
+// starts a Period early and replicates it to the others, which keep counting the tokens
+// taken in the previous Period against their quota until their own clock reaches it.
+// That way quotas never reset early across the cluster, but may reset late on a node
+// by as much as its clock lags behind.
+
+// TakeQuota attempts to take n tokens out of the Bucket with the given Quota at time now.
+// It returns the number of remaining tokens in the Quota's current Period and if the take
+// was successful.
+func (b *Bucket) TakeQuota(now time.Time, q Quota, n uint64) (remaining uint64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.quota = q
+	have := b.quotaAvailable(now, q)
+
+	taken := float64(n)
+	if taken > have {
+		return uint64(have), false
+	}
+
+	if period := q.period(now); period > b.window {
+		if period == b.window+1 {
+			b.prev = b.curr
+		} else {
+			b.prev = 0
+		}
+		b.window, b.curr = period, 0
+	}
+	b.curr += taken
+
+	return uint64(have - taken), true
+}
+
+// PeekQuota returns the same results as TakeQuota would, without taking any tokens.
+func (b *Bucket) PeekQuota(now time.Time, q Quota, n uint64) (remaining uint64, ok bool) {
+	b.mu.RLock()
+	have := b.quotaAvailable(now, q)
+	b.mu.RUnlock()
+
+	if taken := float64(n); taken <= have {
+		return uint64(have - taken), true
+	}
+	return uint64(have), false
+}
+
+// quotaAvailable returns the tokens that can be taken at time now with the given Quota.
+// It must be called with the lock held.
+func (b *Bucket) quotaAvailable(now time.Time, q Quota) float64 {
+	var used float64
+	switch period := q.period(now); {
+	case period == b.window:
+		used = b.curr
+	case period < b.window: // Our clock is behind the cluster's.
+		used = b.curr + b.prev
+	}
+
+	if limit := float64(q.Limit); used < limit {
+		return limit - used
+	}
+	return 0
+}
+
+// quotaDelay implements Delay for Quota Buckets, at the Quota of their last take.
+// It must be called with the read lock held.
+func (b *Bucket) quotaDelay(now time.Time, n uint64) (time.Duration, bool) {
+	switch {
+	case float64(n) <= b.quotaAvailable(now, b.quota):
+		return 0, true
+	case n > b.quota.Limit:
+		return 0, false
+	}
+	return b.quota.Reset(now).Sub(now), true
+}
+
+// quotaExpired returns true if no tokens were taken in the Period which contains
+// time now, and the last take happened at least ttl before it. It must be called
+// with the read lock held.
+func (b *Bucket) quotaExpired(now time.Time, ttl time.Duration) bool {
+	if b.quota.Limit == 0 { // Only merged from peers, so the Period is unknown.
+		return b.untouched(now, ttl)
+	}
+	return b.quota.period(now) > b.window && b.quota.period(now.Add(-ttl)) > b.window
+}
@@ -0,0 +1,141 @@
+package patrol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseQuota(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: "10000:month", want: "10000:month"},
+		{in: "500:day:UTC", want: "500:day"},
+		{in: "500:week:Europe/Berlin", want: "500:week:Europe/Berlin"},
+		{in: "500", err: true},
+		{in: "500:year", err: true},
+		{in: "-1:day", err: true},
+		{in: "500:day:Nowhere/Land", err: true},
+	} {
+		q, err := ParseQuota(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("ParseQuota(%q): want error, have %v", tc.in, q)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseQuota(%q): %v", tc.in, err)
+		} else if have := q.String(); have != tc.want {
+			t.Errorf("ParseQuota(%q): have %q, want %q", tc.in, have, tc.want)
+		}
+	}
+}
+
+func TestQuota_Reset(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	now := time.Date(2019, 6, 30, 23, 30, 0, 0, time.UTC) // A Sunday, already Monday in loc.
+
+	for _, tc := range []struct {
+		quota Quota
+		want  time.Time
+	}{
+		{quota: Quota{Period: Daily}, want: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{quota: Quota{Period: Weekly}, want: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{quota: Quota{Period: Monthly}, want: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{quota: Quota{Period: Daily, Location: loc}, want: time.Date(2019, 7, 2, 0, 0, 0, 0, loc)},
+		{quota: Quota{Period: Weekly, Location: loc}, want: time.Date(2019, 7, 8, 0, 0, 0, 0, loc)},
+		{quota: Quota{Period: Monthly, Location: loc}, want: time.Date(2019, 8, 1, 0, 0, 0, 0, loc)},
+	} {
+		if have := tc.quota.Reset(now); !have.Equal(tc.want) {
+			t.Errorf("%v in %v: have reset %v, want %v", tc.quota.Period, tc.quota.location(), have, tc.want)
+		}
+
+		// Periods change exactly at their reset.
+		if a, b := tc.quota.period(tc.want.Add(-1)), tc.quota.period(tc.want); b != a+1 {
+			t.Errorf("%v in %v: have periods %d and %d around reset", tc.quota.Period, tc.quota.location(), a, b)
+		}
+	}
+}
+
+func TestBucket_TakeQuota(t *testing.T) {
+	quota := Quota{Limit: 10, Period: Monthly}
+	bucket := Bucket{algo: CalendarQuota}
+	now := time.Date(2019, 6, 30, 23, 0, 0, 0, time.UTC)
+
+	for i, tc := range []struct {
+		elapsed time.Duration
+		take    uint64
+		ok      bool
+		rem     uint64
+	}{
+		{elapsed: 0, take: 8, ok: true, rem: 2},
+		{elapsed: 30 * time.Minute, take: 3, ok: false, rem: 2},
+		{elapsed: 30 * time.Minute, take: 3, ok: true, rem: 7}, // A new month.
+		{elapsed: 24 * time.Hour, take: 8, ok: false, rem: 7},
+		{elapsed: 0, take: 11, ok: false, rem: 7},
+	} {
+		now = now.Add(tc.elapsed)
+		rem, ok := bucket.TakeQuota(now, quota, tc.take)
+		if ok != tc.ok || rem != tc.rem {
+			t.Errorf("step %d: have (%t, %d), want (%t, %d)", i, ok, rem, tc.ok, tc.rem)
+		}
+	}
+
+	if delay, ok := bucket.Delay(now, Rate{}, 8); !ok || delay != quota.Reset(now).Sub(now) {
+		t.Errorf("have delay (%s, %t), want until the next month", delay, ok)
+	}
+}
+
+func TestBucket_TakeQuotaClockBehind(t *testing.T) {
+	quota := Quota{Limit: 10, Period: Daily}
+	midnight := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	// A node whose clock is ahead starts the next day early.
+	ahead := Bucket{algo: CalendarQuota}
+	ahead.TakeQuota(midnight.Add(-time.Hour), quota, 9)
+	ahead.TakeQuota(midnight, quota, 1)
+
+	// A node whose clock is behind keeps counting the previous day.
+	var behind Bucket
+	behind.Merge(&ahead)
+	if rem, ok := behind.TakeQuota(midnight.Add(-time.Second), quota, 1); ok || rem != 0 {
+		t.Errorf("have (%t, %d) before midnight, want (false, 0)", ok, rem)
+	}
+
+	if rem, ok := behind.TakeQuota(midnight, quota, 1); !ok || rem != 8 {
+		t.Errorf("have (%t, %d) after midnight, want (true, 8)", ok, rem)
+	}
+}
+
+func TestBucket_QuotaExpired(t *testing.T) {
+	quota := Quota{Limit: 10, Period: Daily}
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	ttl := time.Hour
+
+	taken := &Bucket{algo: CalendarQuota}
+	taken.TakeQuota(now, quota, 10)
+
+	merged := &Bucket{created: now}
+	merged.Merge(taken)
+
+	if taken.Expired(now.Add(ttl), ttl) {
+		t.Error("want Bucket to not expire during the period it was taken from")
+	}
+
+	later := now.Add(24 * time.Hour)
+	if !taken.Expired(later, ttl) {
+		t.Error("want Bucket to expire once its period ended more than a TTL ago")
+	}
+
+	if merged.Expired(now.Add(ttl/2), ttl) {
+		t.Error("want Bucket merged from peers, of unknown quota, to not expire while touched")
+	}
+
+	if !merged.Expired(later, ttl) {
+		t.Error("want Bucket merged from peers, of unknown quota, to expire a TTL after its creation")
+	}
+}
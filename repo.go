@@ -1,9 +1,15 @@
 package patrol
 
 import (
+	"container/heap"
 	"context"
+	"io"
+	"math"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -14,7 +20,128 @@ import (
 // Implementations must be safe for concurrent use.
 type Repo interface {
 	GetBucket(ctx context.Context, name string) (*Bucket, bool)
+	LookupBucket(ctx context.Context, name string) (*Bucket, bool)
 	UpsertBucket(ctx context.Context, b *Bucket) (merged *Bucket, created bool)
+	DeleteBucket(ctx context.Context, name string) (deleted bool)
+	ListBuckets(ctx context.Context, opts ListOptions) []*Bucket
+}
+
+// A bucketRanger is a Repo which can list all of its Buckets without ordering them,
+// which is much cheaper than a ListBuckets of all of them.
+type bucketRanger interface {
+	allBuckets(ctx context.Context) []*Bucket
+}
+
+// allBuckets returns all Buckets in the given Repo, in no particular order.
+func allBuckets(ctx context.Context, r Repo) []*Bucket {
+	if br, ok := r.(bucketRanger); ok {
+		return br.allBuckets(ctx)
+	}
+	return r.ListBuckets(ctx, ListOptions{Limit: math.MaxInt32})
+}
+
+// ListOptions define which Buckets are returned by Repo.ListBuckets and in what order.
+type ListOptions struct {
+	// Prefix that the names of listed Buckets must have.
+	Prefix string
+	// SortByTaken sorts Buckets by tokens taken in descending order,
+	// instead of by name in ascending order.
+	SortByTaken bool
+	// After is the name of the Bucket after which Buckets are listed, used for
+	// pagination. When sorting by tokens taken, AfterTaken is the number of tokens
+	// that Bucket had taken when it was listed, and Buckets are listed after that
+	// position instead. Since tokens keep being taken, such pages skip or repeat the
+	// Buckets whose tokens taken changed in between.
+	After      string
+	AfterTaken float64
+	// Limit is the maximum number of Buckets to list.
+	Limit int
+}
+
+// matches returns true if the given Bucket's name matches the ListOptions.
+func (o *ListOptions) matches(b *Bucket) bool {
+	return strings.HasPrefix(b.name, o.Prefix) && (o.SortByTaken || b.name > o.After)
+}
+
+// after returns true if the given listKey is ordered after the one of the ListOptions.
+func (o *ListOptions) after(key listKey) bool {
+	return o.After == "" || o.less(listKey{name: o.After, taken: o.AfterTaken}, key)
+}
+
+// A listKey is the position of a Bucket in a listing.
+type listKey struct {
+	name  string
+	taken float64
+}
+
+// key returns the listKey of the given Bucket.
+func (o *ListOptions) key(b *Bucket) listKey {
+	key := listKey{name: b.name}
+	if o.SortByTaken {
+		b.mu.RLock()
+		switch key.taken = b.taken; b.algo {
+		case SlidingWindow, FixedWindow, CalendarQuota:
+			key.taken = b.curr
+		case Concurrency:
+			key.taken = b.acquired - b.released
+		}
+		b.mu.RUnlock()
+	}
+	return key
+}
+
+// less returns true if the key a is ordered before b.
+func (o *ListOptions) less(a, b listKey) bool {
+	if o.SortByTaken && a.taken != b.taken {
+		return a.taken > b.taken
+	}
+	return a.name < b.name
+}
+
+// A bucketHeap keeps the first Limit Buckets in ListOptions order, with the last
+// of them at the top so that it can be replaced by ones ordered before it.
+type bucketHeap struct {
+	opts    *ListOptions
+	entries []listEntry
+}
+
+type listEntry struct {
+	key    listKey
+	bucket *Bucket
+}
+
+func (h *bucketHeap) Len() int           { return len(h.entries) }
+func (h *bucketHeap) Less(i, j int) bool { return h.opts.less(h.entries[j].key, h.entries[i].key) }
+func (h *bucketHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *bucketHeap) Push(x interface{}) { h.entries = append(h.entries, x.(listEntry)) }
+func (h *bucketHeap) Pop() interface{} {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
+
+// offer adds the given Bucket, which must match the ListOptions, if it's ordered
+// after the ListOptions' position and among the first Limit Buckets offered so far.
+func (h *bucketHeap) offer(b *Bucket) {
+	key := h.opts.key(b)
+	if !h.opts.after(key) {
+		return
+	} else if len(h.entries) < h.opts.Limit {
+		heap.Push(h, listEntry{key: key, bucket: b})
+	} else if h.opts.less(key, h.entries[0].key) {
+		h.entries[0] = listEntry{key: key, bucket: b}
+		heap.Fix(h, 0)
+	}
+}
+
+// sorted returns the Buckets in ListOptions order.
+func (h *bucketHeap) sorted() []*Bucket {
+	sort.Sort(sort.Reverse(h))
+	bs := make([]*Bucket, len(h.entries))
+	for i, e := range h.entries {
+		bs[i] = e.bucket
+	}
+	return bs
 }
 
 // A ReplicatedRepo stores, retrieves and replicates Buckets across the cluster.
@@ -24,6 +151,15 @@ type ReplicatedRepo struct {
 	conn    net.PacketConn
 	repo    Repo
 	incasts singleflight.Group
+	sending sync.RWMutex // Read locked by sends, and locked by Drain to wait for them.
+	labels  sync.Map     // Peers by the string of their resolved addresses.
+
+	// Metrics by configured peer, or otherPeer.
+	sent            *counterVec
+	received        *counterVec
+	merged          *counterVec
+	dropped         *counterVec
+	unmarshalErrors *counterVec
 }
 
 // NewReplicatedRepo returns a new Repo that receives and sends UDP packets from the given addr to all peers.
@@ -32,7 +168,12 @@ func NewReplicatedRepo(log *zap.Logger, r Repo, addr string, peers []string) (*R
 	if err != nil {
 		return nil, err
 	}
+	return newReplicatedRepo(log, r, addr, conn, peers), nil
+}
 
+// newReplicatedRepo returns a new ReplicatedRepo which uses the given connection,
+// listening on addr.
+func newReplicatedRepo(log *zap.Logger, r Repo, addr string, conn net.PacketConn, peers []string) *ReplicatedRepo {
 	addrs := make([]string, 0, len(peers))
 	for _, peer := range peers {
 		if peer != addr {
@@ -42,12 +183,38 @@ func NewReplicatedRepo(log *zap.Logger, r Repo, addr string, peers []string) (*R
 
 	log.Debug("peers", zap.String("self", addr), zap.Strings("others", addrs))
 
-	return &ReplicatedRepo{
-		log:   log,
-		peers: addrs,
-		conn:  conn,
-		repo:  r,
-	}, nil
+	rr := &ReplicatedRepo{
+		log:             log,
+		peers:           addrs,
+		conn:            conn,
+		repo:            r,
+		sent:            newCounterVec("peer"),
+		received:        newCounterVec("peer"),
+		merged:          newCounterVec("peer"),
+		dropped:         newCounterVec("peer"),
+		unmarshalErrors: newCounterVec("peer"),
+	}
+
+	for _, peer := range addrs {
+		if addr, err := net.ResolveUDPAddr("udp", peer); err == nil {
+			rr.labels.Store(addr.String(), peer)
+		}
+	}
+
+	return rr
+}
+
+// otherPeer is the metrics label of packets received from, or unicast to, addresses
+// which aren't those of any configured peer, so that they can't grow metrics unbounded.
+const otherPeer = "other"
+
+// peerLabel returns the configured peer with the given address, as resolved by the
+// last broadcast, or otherPeer.
+func (r *ReplicatedRepo) peerLabel(addr net.Addr) string {
+	if peer, ok := r.labels.Load(addr.String()); ok {
+		return peer.(string)
+	}
+	return otherPeer
 }
 
 // Receive starts receiving and applying Bucket state updates from other peers.
@@ -62,21 +229,41 @@ func (r *ReplicatedRepo) Receive(ctx context.Context) error {
 		default:
 		}
 
-		addr, err := r.receive(&remote, buf)
+		data, addr, err := r.receive(buf)
 		switch e := err.(type) {
 		case nil:
 		case net.Error:
 			if e.Temporary() || e.Timeout() {
 				continue
 			}
+			return err
 		default:
 			return err
 		}
 
+		peer := r.peerLabel(addr)
+		r.received.with(peer).inc()
+
+		if err = remote.UnmarshalBinary(data); err != nil {
+			r.unmarshalErrors.with(peer).inc()
+			r.log.Error("unmarshal failed", zap.Stringer("peer", addr), zap.Error(err))
+			continue
+		}
+
 		r.log.Debug("received", zap.Stringer("peer", addr), zap.Object("bucket", &remote))
 
 		if local, ok := r.repo.GetBucket(ctx, remote.name); !remote.IsZero() {
+			if local.Conflicts(&remote) {
+				r.log.Error("conflicting algorithms",
+					zap.Stringer("peer", addr),
+					zap.Object("remote", &remote),
+					zap.Object("local", local),
+				)
+				continue
+			}
+
 			local.Merge(&remote)
+			r.merged.with(peer).inc()
 			r.log.Debug("upsert",
 				zap.Stringer("peer", addr),
 				zap.Bool("created", !ok),
@@ -105,18 +292,20 @@ func (r *ReplicatedRepo) GetBucket(ctx context.Context, name string) (*Bucket, b
 	return b, ok
 }
 
-func (r *ReplicatedRepo) receive(b *Bucket, buf []byte) (net.Addr, error) {
+// LookupBucket gets a Bucket by its name from the local Repo, without creating it
+// if it doesn't exist.
+func (r *ReplicatedRepo) LookupBucket(ctx context.Context, name string) (*Bucket, bool) {
+	return r.repo.LookupBucket(ctx, name)
+}
+
+func (r *ReplicatedRepo) receive(buf []byte) ([]byte, net.Addr, error) {
 	err := r.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	n, addr, err := r.conn.ReadFrom(buf)
-	if err != nil {
-		return addr, err
-	}
-
-	return addr, b.UnmarshalBinary(buf[:n])
+	return buf[:n], addr, err
 }
 
 // UpsertBucket upserts the given Bucket and broadcasts to all nodes in the cluster.
@@ -126,7 +315,71 @@ func (r *ReplicatedRepo) UpsertBucket(ctx context.Context, b *Bucket) (upserted
 	return upserted, ok
 }
 
+// ListBuckets lists Buckets from the local Repo.
+func (r *ReplicatedRepo) ListBuckets(ctx context.Context, opts ListOptions) []*Bucket {
+	return r.repo.ListBuckets(ctx, opts)
+}
+
+func (r *ReplicatedRepo) allBuckets(ctx context.Context) []*Bucket {
+	return allBuckets(ctx, r.repo)
+}
+
+// DeleteBucket deletes a Bucket by its name from the local Repo only. Since Bucket state
+// only ever grows when merged, deletes can't be replicated. Callers must Refill and upsert
+// the Bucket before deleting it so that the cluster converges to the same state as that of
+// a re-created Bucket.
+func (r *ReplicatedRepo) DeleteBucket(ctx context.Context, name string) bool {
+	return r.repo.DeleteBucket(ctx, name)
+}
+
+// Drain waits for pending broadcasts to be sent and then broadcasts the state of
+// every local Bucket, so that peers converge to it even if earlier packets were
+// lost. It returns the number of Buckets broadcast. Broadcasts of Buckets taken
+// meanwhile wait for it to return. It must be called before Close.
+func (r *ReplicatedRepo) Drain(ctx context.Context) (synced int, err error) {
+	locked := make(chan struct{})
+	go func() {
+		r.sending.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		go func() { // Don't block broadcasts forever once the pending ones are sent.
+			<-locked
+			r.sending.Unlock()
+		}()
+		return 0, ctx.Err()
+	}
+	defer r.sending.Unlock()
+
+	for _, b := range allBuckets(ctx, r.repo) {
+		if err = ctx.Err(); err != nil {
+			return synced, err
+		}
+		if !b.IsZero() { // Zero Buckets would be taken as incast requests.
+			r.broadcastLocked(b)
+			synced++
+		}
+	}
+
+	return synced, nil
+}
+
+// Close closes the UDP connection, after which Receive returns.
+func (r *ReplicatedRepo) Close() error {
+	return r.conn.Close()
+}
+
 func (r *ReplicatedRepo) broadcast(b *Bucket) {
+	r.sending.RLock()
+	defer r.sending.RUnlock()
+	r.broadcastLocked(b)
+}
+
+// broadcastLocked implements broadcast. It must be called with the sending lock held.
+func (r *ReplicatedRepo) broadcastLocked(b *Bucket) {
 	r.log.Debug("broadcasting", zap.Object("bucket", b))
 
 	data, err := b.MarshalBinary()
@@ -143,7 +396,8 @@ func (r *ReplicatedRepo) broadcast(b *Bucket) {
 	for _, peer := range r.peers {
 		go func(op operation) {
 			var addr net.Addr
-			if addr, op.err = net.ResolveUDPAddr("udp", op.peer); err == nil {
+			if addr, op.err = net.ResolveUDPAddr("udp", op.peer); op.err == nil {
+				r.labels.Store(addr.String(), op.peer)
 				_, op.err = r.conn.WriteTo(data, addr)
 			}
 			opch <- op
@@ -152,34 +406,76 @@ func (r *ReplicatedRepo) broadcast(b *Bucket) {
 
 	for range r.peers {
 		if op := <-opch; op.err != nil {
-			r.log.Error("broadcasting", zap.String("peer", op.peer), zap.Object("bucket", b))
+			r.dropped.with(op.peer).inc()
+			r.log.Error("broadcasting", zap.String("peer", op.peer), zap.Object("bucket", b), zap.Error(op.err))
+		} else {
+			r.sent.with(op.peer).inc()
 		}
 	}
 }
 
 func (r *ReplicatedRepo) unicast(b *Bucket, addr net.Addr) error {
+	r.sending.RLock()
+	defer r.sending.RUnlock()
+
 	r.log.Debug("unicasting", zap.Stringer("peer", addr), zap.Object("bucket", b))
 
 	data, err := b.MarshalBinary()
 	if err != nil {
 		return err
 	}
-	_, err = r.conn.WriteTo(data, addr)
-	return err
+
+	if _, err = r.conn.WriteTo(data, addr); err != nil {
+		r.dropped.with(r.peerLabel(addr)).inc()
+		return err
+	}
+
+	r.sent.with(r.peerLabel(addr)).inc()
+	return nil
+}
+
+func (r *ReplicatedRepo) writeMetrics(w io.Writer) {
+	r.sent.write(w, "patrol_replication_packets_sent_total", "Total number of Bucket packets sent by peer.")
+	r.received.write(w, "patrol_replication_packets_received_total", "Total number of Bucket packets received by peer.")
+	r.merged.write(w, "patrol_replication_packets_merged_total", "Total number of received Bucket packets merged by peer.")
+	r.dropped.write(w, "patrol_replication_packets_dropped_total", "Total number of Bucket packets which failed to be sent by peer.")
+	r.unmarshalErrors.write(w, "patrol_replication_unmarshal_errors_total", "Total number of received Bucket packets which failed to be decoded by peer.")
+	if m, ok := r.repo.(metricsWriter); ok {
+		m.writeMetrics(w)
+	}
 }
 
 // A LocalRepo stores Buckets locally in-memory. It's safe for concurrent use.
+//
+// A LocalRepo can be bounded to a maximum number of Buckets, in which case
+// inserting a new Bucket into a full LocalRepo evicts an approximately least
+// recently used one, as chosen by the CLOCK algorithm.
+//
+// A Bucket evicted this way loses its local state: a later Take on the same name
+// operates on a new, full Bucket, just like a Take on a never seen name. When
+// replicated, a new Bucket asks the cluster for its state and merges it as it
+// arrives, so the over-admission is bounded by the Bucket's capacity in each node.
 type LocalRepo struct {
-	mu      sync.RWMutex
-	clock   func() time.Time
-	buckets map[string]*Bucket
+	evictions uint64 // accessed atomically, keep 64-bit aligned.
+	mu        sync.RWMutex
+	clock     func() time.Time
+	buckets   map[string]*Bucket
+	max       int       // Maximum number of Buckets. Zero means unbounded.
+	ring      []*Bucket // CLOCK ring of Buckets when bounded.
+	hand      int       // CLOCK hand position in ring.
 }
 
-// NewLocalRepo returns a new LocalRepo with the given Buckets in it.
+// NewLocalRepo returns a new unbounded LocalRepo with the given Buckets in it.
 func NewLocalRepo(clock func() time.Time, bs ...*Bucket) *LocalRepo {
-	r := LocalRepo{clock: clock, buckets: make(map[string]*Bucket, len(bs))}
+	return NewBoundedLocalRepo(clock, 0, bs...)
+}
+
+// NewBoundedLocalRepo returns a new LocalRepo with the given Buckets in it, bounded to
+// hold at most max Buckets. A zero max means unbounded.
+func NewBoundedLocalRepo(clock func() time.Time, max int, bs ...*Bucket) *LocalRepo {
+	r := LocalRepo{clock: clock, max: max, buckets: make(map[string]*Bucket, len(bs))}
 	for _, b := range bs {
-		r.buckets[b.name] = b
+		r.insert(b)
 	}
 	return &r
 }
@@ -194,6 +490,7 @@ func (r *LocalRepo) GetBucket(_ context.Context, name string) (*Bucket, bool) {
 	r.mu.RUnlock()
 
 	if ok { // We have this bucket, so we return it immediately.
+		r.touch(b)
 		return b, ok
 	}
 
@@ -203,13 +500,22 @@ func (r *LocalRepo) GetBucket(_ context.Context, name string) (*Bucket, bool) {
 	r.mu.Lock()
 	if b, ok = r.buckets[name]; !ok {
 		b = &Bucket{name: name, created: r.clock()}
-		r.buckets[name] = b
+		r.insert(b)
 	}
 	r.mu.Unlock()
 
 	return b, ok
 }
 
+// LookupBucket retrieves a Bucket with the given name, without creating it if it
+// doesn't exist.
+func (r *LocalRepo) LookupBucket(_ context.Context, name string) (*Bucket, bool) {
+	r.mu.RLock()
+	b, ok := r.buckets[name]
+	r.mu.RUnlock()
+	return b, ok
+}
+
 // UpsertBucket upserts the given Bucket in the Repo. If it already exists, the given Bucket
 // is merged with the stored Bucket.
 func (r *LocalRepo) UpsertBucket(_ context.Context, b *Bucket) (upserted *Bucket, ok bool) {
@@ -223,13 +529,327 @@ func (r *LocalRepo) UpsertBucket(_ context.Context, b *Bucket) (upserted *Bucket
 
 	r.mu.Lock()
 	if prev = r.buckets[b.name]; prev == nil {
-		b.created = r.clock()
-		r.buckets[b.name] = b
+		// Buckets that were evicted after being retrieved keep their original
+		// created timestamp, which their elapsed duration is relative to.
+		if b.created.IsZero() {
+			b.created = r.clock()
+		}
+		atomic.StoreInt64(&b.touched, r.clock().UnixNano())
+		r.insert(b)
 		r.mu.Unlock()
 		return b, false
 	}
 	r.mu.Unlock()
 
+	r.touch(prev)
 	prev.Merge(b)
 	return prev, true
 }
+
+// DeleteBucket deletes the Bucket with the given name, returning true if it existed.
+func (r *LocalRepo) DeleteBucket(_ context.Context, name string) bool {
+	r.mu.Lock()
+	_, ok := r.buckets[name]
+	delete(r.buckets, name)
+	r.mu.Unlock()
+	return ok
+}
+
+// ListBuckets lists Buckets according to the given ListOptions. Only the first Limit
+// Buckets are kept while scanning, so the read lock is held for a single pass over
+// the Buckets and listing uses memory proportional to the Limit rather than to them.
+func (r *LocalRepo) ListBuckets(_ context.Context, opts ListOptions) []*Bucket {
+	if opts.Limit <= 0 {
+		return nil
+	}
+
+	h := bucketHeap{opts: &opts}
+	r.mu.RLock()
+	for _, b := range r.buckets {
+		if opts.matches(b) {
+			h.offer(b)
+		}
+	}
+	r.mu.RUnlock()
+
+	return h.sorted()
+}
+
+func (r *LocalRepo) allBuckets(context.Context) []*Bucket {
+	r.mu.RLock()
+	bs := make([]*Bucket, 0, len(r.buckets))
+	for _, b := range r.buckets {
+		bs = append(bs, b)
+	}
+	r.mu.RUnlock()
+	return bs
+}
+
+// touch marks the given Bucket as recently used.
+func (r *LocalRepo) touch(b *Bucket) {
+	atomic.StoreInt64(&b.touched, r.clock().UnixNano())
+
+	// Avoid writing to the shared cache line when the flag is already set.
+	if r.max > 0 && atomic.LoadUint32(&b.referenced) == 0 {
+		atomic.StoreUint32(&b.referenced, 1)
+	}
+}
+
+// insert adds the given Bucket to the Repo, evicting another one if the
+// Repo is full. It must be called with the write lock held.
+func (r *LocalRepo) insert(b *Bucket) {
+	if r.max <= 0 {
+		r.buckets[b.name] = b
+		return
+	}
+
+	if len(r.ring) < r.max {
+		r.buckets[b.name] = b
+		r.ring = append(r.ring, b)
+		return
+	}
+
+	// Advance the hand until we find a slot whose Bucket was already removed
+	// or hasn't been referenced since the hand last went by it.
+	for {
+		victim := r.ring[r.hand]
+		if r.buckets[victim.name] != victim {
+			break
+		}
+		if atomic.SwapUint32(&victim.referenced, 0) == 0 {
+			delete(r.buckets, victim.name)
+			atomic.AddUint64(&r.evictions, 1)
+			break
+		}
+		r.hand = (r.hand + 1) % len(r.ring)
+	}
+
+	r.buckets[b.name] = b
+	r.ring[r.hand] = b
+	r.hand = (r.hand + 1) % len(r.ring)
+}
+
+// Sweep evicts expired Buckets every given interval until the context is done.
+// See Evict for the eviction criteria.
+func (r *LocalRepo) Sweep(ctx context.Context, interval, ttl time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			r.Evict(ttl)
+		}
+	}
+}
+
+// Evict removes all Buckets that have fully refilled and have been idle for longer
+// than the given ttl. It returns the number of evicted Buckets.
+func (r *LocalRepo) Evict(ttl time.Duration) (evicted int) {
+	now := r.clock()
+
+	// Find candidates with the read lock held so that GetBucket isn't blocked
+	// while we scan the whole map.
+	var expired []*Bucket
+	r.mu.RLock()
+	for _, b := range r.buckets {
+		if b.Expired(now, ttl) {
+			expired = append(expired, b)
+		}
+	}
+	r.mu.RUnlock()
+
+	if len(expired) == 0 {
+		return 0
+	}
+
+	// Re-check with the write lock held since a Take may have happened in between.
+	r.mu.Lock()
+	for _, b := range expired {
+		if r.buckets[b.name] == b && b.Expired(now, ttl) {
+			delete(r.buckets, b.name)
+			evicted++
+		}
+	}
+	r.mu.Unlock()
+
+	atomic.AddUint64(&r.evictions, uint64(evicted))
+	return evicted
+}
+
+// Len returns the number of Buckets in the LocalRepo.
+func (r *LocalRepo) Len() int {
+	r.mu.RLock()
+	n := len(r.buckets)
+	r.mu.RUnlock()
+	return n
+}
+
+func (r *LocalRepo) writeMetrics(w io.Writer) {
+	writeRepoMetrics(w, r.Len(), r.Evictions())
+}
+
+// Evictions returns the total number of Buckets evicted from the LocalRepo,
+// either because they expired or because the LocalRepo was full.
+func (r *LocalRepo) Evictions() uint64 {
+	return atomic.LoadUint64(&r.evictions)
+}
+
+// A ShardedRepo stores Buckets locally in-memory, spread across multiple
+// independently locked LocalRepo shards by the hash of their names, which
+// reduces lock contention under high cardinality concurrent access.
+// It's safe for concurrent use.
+type ShardedRepo struct {
+	shards []*LocalRepo
+}
+
+// NewShardedRepo returns a new ShardedRepo with n shards which hold at most
+// max Buckets in total. A zero max means unbounded. Each shard holds an equal
+// share of max, so a shard may evict Buckets while others still have room, and
+// fewer than n shards are used when max is smaller than n.
+func NewShardedRepo(clock func() time.Time, n, max int, bs ...*Bucket) *ShardedRepo {
+	if n < 1 {
+		n = 1
+	}
+
+	if max > 0 && n > max {
+		n = max
+	}
+
+	r := ShardedRepo{shards: make([]*LocalRepo, n)}
+	for i := range r.shards {
+		perShard := max / n
+		if i < max%n { // Spread the remainder so that the shards hold max in total.
+			perShard++
+		}
+		r.shards[i] = NewBoundedLocalRepo(clock, perShard)
+	}
+
+	for _, b := range bs {
+		shard := r.shard(b.name)
+		shard.mu.Lock()
+		shard.insert(b)
+		shard.mu.Unlock()
+	}
+
+	return &r
+}
+
+// shard returns the LocalRepo shard the given name belongs to.
+func (r *ShardedRepo) shard(name string) *LocalRepo {
+	// Inlined 32-bit FNV-1a to avoid allocations.
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	h := uint32(offset32)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= prime32
+	}
+
+	return r.shards[h%uint32(len(r.shards))]
+}
+
+// GetBucket retrieves a Bucket with the given name, creating it first if it doesn't
+// yet exist.
+func (r *ShardedRepo) GetBucket(ctx context.Context, name string) (*Bucket, bool) {
+	return r.shard(name).GetBucket(ctx, name)
+}
+
+// LookupBucket retrieves a Bucket with the given name, without creating it if it
+// doesn't exist.
+func (r *ShardedRepo) LookupBucket(ctx context.Context, name string) (*Bucket, bool) {
+	return r.shard(name).LookupBucket(ctx, name)
+}
+
+// UpsertBucket upserts the given Bucket in the Repo. If it already exists, the given Bucket
+// is merged with the stored Bucket.
+func (r *ShardedRepo) UpsertBucket(ctx context.Context, b *Bucket) (*Bucket, bool) {
+	return r.shard(b.name).UpsertBucket(ctx, b)
+}
+
+// DeleteBucket deletes the Bucket with the given name, returning true if it existed.
+func (r *ShardedRepo) DeleteBucket(ctx context.Context, name string) bool {
+	return r.shard(name).DeleteBucket(ctx, name)
+}
+
+// ListBuckets lists Buckets from all shards according to the given ListOptions,
+// one shard at a time.
+func (r *ShardedRepo) ListBuckets(ctx context.Context, opts ListOptions) []*Bucket {
+	h := bucketHeap{opts: &opts}
+	if opts.Limit <= 0 {
+		return nil
+	}
+
+	for _, shard := range r.shards {
+		for _, b := range shard.ListBuckets(ctx, opts) {
+			h.offer(b)
+		}
+	}
+
+	return h.sorted()
+}
+
+func (r *ShardedRepo) allBuckets(ctx context.Context) []*Bucket {
+	var bs []*Bucket
+	for _, shard := range r.shards {
+		bs = append(bs, shard.allBuckets(ctx)...)
+	}
+	return bs
+}
+
+// Sweep evicts expired Buckets from all shards every given interval until the
+// context is done. See LocalRepo.Evict for the eviction criteria.
+func (r *ShardedRepo) Sweep(ctx context.Context, interval, ttl time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			r.Evict(ttl)
+		}
+	}
+}
+
+// Evict removes all expired Buckets from all shards, one shard at a time.
+// It returns the number of evicted Buckets.
+func (r *ShardedRepo) Evict(ttl time.Duration) (evicted int) {
+	for _, shard := range r.shards {
+		evicted += shard.Evict(ttl)
+	}
+	return evicted
+}
+
+// Evictions returns the total number of Buckets evicted from all shards.
+func (r *ShardedRepo) Evictions() (evictions uint64) {
+	for _, shard := range r.shards {
+		evictions += shard.Evictions()
+	}
+	return evictions
+}
+
+// Len returns the number of Buckets in all shards.
+func (r *ShardedRepo) Len() (n int) {
+	for _, shard := range r.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+func (r *ShardedRepo) writeMetrics(w io.Writer) {
+	writeRepoMetrics(w, r.Len(), r.Evictions())
+}
+
+func writeRepoMetrics(w io.Writer, buckets int, evictions uint64) {
+	writeHeader(w, "patrol_buckets", "Number of Buckets held in memory.", "gauge")
+	writeSample(w, "patrol_buckets", "", float64(buckets))
+	writeHeader(w, "patrol_bucket_evictions_total", "Total number of evicted Buckets.", "counter")
+	writeSample(w, "patrol_bucket_evictions_total", "", float64(evictions))
+}
@@ -0,0 +1,264 @@
+package patrol
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestLocalRepo_Evict(t *testing.T) {
+	ctx := context.Background()
+	rate := Rate{Freq: 10, Per: time.Second}
+	ttl := time.Minute
+
+	now := time.Now()
+	repo := NewLocalRepo(func() time.Time { return now })
+
+	full, _ := repo.GetBucket(ctx, "full")
+	full.Take(now, rate, 1)
+
+	empty, _ := repo.GetBucket(ctx, "empty")
+	empty.Take(now, Rate{Freq: 10, Per: time.Hour}, 10)
+
+	merged, _ := repo.GetBucket(ctx, "merged")
+	merged.Merge(&Bucket{name: "merged", added: 10, taken: 10})
+
+	repo.UpsertBucket(ctx, &Bucket{name: "received", added: 10, taken: 10})
+
+	repo.GetBucket(ctx, "incast")
+
+	now = now.Add(ttl / 2)
+	recent, _ := repo.GetBucket(ctx, "recent")
+	recent.Take(now, rate, 1)
+
+	repo.UpsertBucket(ctx, &Bucket{name: "received", added: 10, taken: 10})
+
+	now = now.Add(ttl/2 + time.Second)
+	if have, want := repo.Evict(ttl), 3; have != want {
+		t.Errorf("have %d evictions, want %d", have, want)
+	}
+
+	for name, want := range map[string]bool{
+		"full":     false, // Idle for longer than ttl and refilled.
+		"empty":    true,  // Idle for longer than ttl but not refilled.
+		"recent":   true,  // Refilled but not idle for longer than ttl.
+		"merged":   false, // Drained by a peer at an unknown rate, untouched for longer than ttl.
+		"incast":   false, // Never taken from nor merged.
+		"received": true,  // Of an unknown rate but touched since.
+	} {
+		repo.mu.RLock()
+		_, have := repo.buckets[name]
+		repo.mu.RUnlock()
+		if have != want {
+			t.Errorf("bucket %q: have present %t, want %t", name, have, want)
+		}
+	}
+
+	if have, want := repo.Evictions(), uint64(3); have != want {
+		t.Errorf("have %d total evictions, want %d", have, want)
+	}
+}
+
+func TestLocalRepo_MaxBuckets(t *testing.T) {
+	ctx := context.Background()
+	repo := NewBoundedLocalRepo(time.Now, 3)
+
+	for _, name := range []string{"a", "b", "c"} {
+		repo.GetBucket(ctx, name)
+	}
+
+	// Reference "a" so that the CLOCK hand skips it and evicts "b" instead.
+	repo.GetBucket(ctx, "a")
+	repo.GetBucket(ctx, "d")
+
+	repo.mu.RLock()
+	have := len(repo.buckets)
+	_, a := repo.buckets["a"]
+	_, b := repo.buckets["b"]
+	repo.mu.RUnlock()
+
+	if want := 3; have != want {
+		t.Errorf("have %d buckets, want %d", have, want)
+	}
+
+	if !a || b {
+		t.Errorf("have a present %t, b present %t; want true, false", a, b)
+	}
+
+	if have, want := repo.Evictions(), uint64(1); have != want {
+		t.Errorf("have %d evictions, want %d", have, want)
+	}
+
+	// Buckets evicted after being retrieved are re-created by UpsertBucket
+	// without being merged with anything.
+	bucket := &Bucket{name: "b", created: time.Now()}
+	if _, ok := repo.UpsertBucket(ctx, bucket); ok {
+		t.Error("evicted bucket should have been re-created")
+	}
+}
+
+func TestShardedRepo(t *testing.T) {
+	ctx := context.Background()
+	repo := NewShardedRepo(time.Now, 4, 0)
+
+	for i := 0; i < 100; i++ {
+		name := strconv.Itoa(i)
+		b, ok := repo.GetBucket(ctx, name)
+		if ok {
+			t.Fatalf("bucket %q: shouldn't exist", name)
+		}
+
+		if again, ok := repo.GetBucket(ctx, name); !ok || again != b {
+			t.Fatalf("bucket %q: have (%p, %t), want (%p, true)", name, again, ok, b)
+		}
+	}
+
+	for i, shard := range repo.shards {
+		if len(shard.buckets) == 0 {
+			t.Errorf("shard %d is empty", i)
+		}
+	}
+}
+
+func TestShardedRepo_MaxBuckets(t *testing.T) {
+	for _, tc := range []struct {
+		n, max, shards int
+	}{
+		{n: 4, max: 0, shards: 4},
+		{n: 4, max: 10, shards: 4},
+		{n: 4, max: 3, shards: 3},
+		{n: 3, max: 1000, shards: 3},
+	} {
+		repo := NewShardedRepo(time.Now, tc.n, tc.max)
+		if len(repo.shards) != tc.shards {
+			t.Errorf("NewShardedRepo(%d, %d): have %d shards, want %d", tc.n, tc.max, len(repo.shards), tc.shards)
+		}
+
+		total := 0
+		for _, shard := range repo.shards {
+			total += shard.max
+		}
+
+		if total != tc.max {
+			t.Errorf("NewShardedRepo(%d, %d): have max %d buckets, want %d", tc.n, tc.max, total, tc.max)
+		}
+	}
+}
+
+func TestReplicatedRepo_PeerLabel(t *testing.T) {
+	peer := "127.0.0.1:12345"
+	repo, err := NewReplicatedRepo(zap.NewNop(), NewLocalRepo(time.Now), "127.0.0.1:0", []string{peer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	for addr, want := range map[string]string{
+		peer:              peer,
+		"127.0.0.1:54321": otherPeer,
+	} {
+		udp, _ := net.ResolveUDPAddr("udp", addr)
+		if have := repo.peerLabel(udp); have != want {
+			t.Errorf("%s: have label %q, want %q", addr, have, want)
+		}
+	}
+}
+
+func BenchmarkRepo(b *testing.B) {
+	names := make([]string, 1<<20)
+	for i := range names {
+		names[i] = strconv.Itoa(i)
+	}
+
+	for _, bc := range []struct {
+		name string
+		repo func() Repo
+	}{
+		{"LocalRepo", func() Repo { return NewLocalRepo(time.Now) }},
+		{"ShardedRepo", func() Repo { return NewShardedRepo(time.Now, runtime.GOMAXPROCS(0), 0) }},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			ctx := context.Background()
+			repo := bc.repo()
+			seed := int64(0)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for pb.Next() {
+					bucket, _ := repo.GetBucket(ctx, names[rng.Intn(len(names))])
+					repo.UpsertBucket(ctx, bucket)
+				}
+			})
+		})
+	}
+}
+
+func TestRepo_ListBuckets(t *testing.T) {
+	ctx := context.Background()
+
+	var buckets []*Bucket
+	for i := 0; i < 50; i++ {
+		buckets = append(buckets, &Bucket{
+			name:  fmt.Sprintf("%c%02d", 'a'+i%2, i),
+			taken: float64(i % 7),
+		})
+	}
+
+	for _, repo := range []Repo{
+		NewLocalRepo(time.Now, buckets...),
+		NewShardedRepo(time.Now, 4, 0, buckets...),
+	} {
+		if have := len(allBuckets(ctx, repo)); have != len(buckets) {
+			t.Errorf("%T: have %d buckets in all, want %d", repo, have, len(buckets))
+		}
+
+		for _, tc := range []struct {
+			opts ListOptions
+			want []string
+		}{
+			{
+				opts: ListOptions{Prefix: "b", Limit: 4},
+				want: []string{"b01", "b03", "b05", "b07", "b09", "b11", "b13", "b15", "b17", "b19", "b21", "b23", "b25", "b27", "b29", "b31", "b33", "b35", "b37", "b39", "b41", "b43", "b45", "b47", "b49"},
+			},
+			{
+				opts: ListOptions{Prefix: "a1", SortByTaken: true, Limit: 2},
+				want: []string{"a12", "a18", "a10", "a16", "a14"}, // taken: 5, 4, 3, 2, 0
+			},
+			{
+				// Buckets with the same tokens taken are ordered by name across pages.
+				opts: ListOptions{Prefix: "b", SortByTaken: true, Limit: 4},
+				want: []string{"b13", "b27", "b41", "b05", "b19", "b33", "b47", "b11", "b25", "b39", "b03", "b17", "b31", "b45", "b09", "b23", "b37", "b01", "b15", "b29", "b43", "b07", "b21", "b35", "b49"},
+			},
+		} {
+			var have []string
+			for opts := tc.opts; ; {
+				page := repo.ListBuckets(ctx, opts)
+				for _, b := range page {
+					have = append(have, b.name)
+				}
+
+				if len(page) < opts.Limit {
+					break
+				}
+				last := opts.key(page[len(page)-1])
+				opts.After, opts.AfterTaken = last.name, last.taken
+			}
+
+			if !reflect.DeepEqual(have, tc.want) {
+				t.Errorf("%T %+v:\nhave %v\nwant %v", repo, tc.opts, have, tc.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package patrol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A snapshot holds the state of Buckets so that a restarted node doesn't reset
+// every limit until the cluster sends it their state. It's laid out as:
+//
+//	magic    [4]byte  "PTRL"
+//	version  uint32   snapshotVersion
+//	count    uint64   number of Buckets
+//	count times:
+//	  created  int64   local creation time of the Bucket in Unix nanoseconds, or zero
+//	  size     uint16  size of the marshaled Bucket
+//	  bucket   [size]byte as marshaled by Bucket.MarshalBinary
+//	checksum uint32   CRC-32C of all the preceding bytes
+//
+// All integers are big endian. The created time is kept alongside the replicated
+// state since token Buckets track time relative to it.
+
+// snapshotVersion is the version of the snapshot format, which must be bumped
+// on any change to it or to the marshaled Bucket format.
+const snapshotVersion = 1
+
+var snapshotMagic = [4]byte{'P', 'T', 'R', 'L'}
+
+// crc32cTable is the CRC-32C table of the checksums of snapshots and journals.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A snapshotRecord is a marshaled Bucket in a snapshot.
+type snapshotRecord struct {
+	created time.Time
+	data    []byte
+}
+
+// ErrSnapshotChecksum is returned when reading a snapshot that was corrupted.
+var ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+// WriteSnapshot writes a snapshot of the given Buckets to w. Zero Buckets are skipped.
+func WriteSnapshot(w io.Writer, bs []*Bucket) error {
+	records := make([]snapshotRecord, 0, len(bs))
+	for _, b := range bs {
+		if b.IsZero() {
+			continue
+		}
+
+		data, err := b.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("bucket %q: %v", b.name, err)
+		}
+
+		b.mu.RLock()
+		created := b.created
+		b.mu.RUnlock()
+
+		records = append(records, snapshotRecord{created: created, data: data})
+	}
+
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(crc32cTable)
+	mw := io.MultiWriter(bw, crc)
+
+	var buf [12]byte
+	copy(buf[:4], snapshotMagic[:])
+	binary.BigEndian.PutUint32(buf[4:], snapshotVersion)
+	mw.Write(buf[:8])
+	binary.BigEndian.PutUint64(buf[:], uint64(len(records)))
+	mw.Write(buf[:8])
+
+	for _, r := range records {
+		var created int64
+		if !r.created.IsZero() {
+			created = r.created.UnixNano()
+		}
+		binary.BigEndian.PutUint64(buf[:], uint64(created))
+		binary.BigEndian.PutUint16(buf[8:], uint16(len(r.data)))
+		mw.Write(buf[:10])
+		mw.Write(r.data)
+	}
+
+	binary.BigEndian.PutUint32(buf[:], crc.Sum32())
+	bw.Write(buf[:4])
+
+	return bw.Flush()
+}
+
+// ReadSnapshot reads the Buckets of a snapshot from r. It returns an error, and no
+// Buckets, if the snapshot is of a different version or fails its checksum.
+func ReadSnapshot(r io.Reader) ([]*Bucket, error) {
+	crc := crc32.New(crc32cTable)
+	tr := io.TeeReader(bufio.NewReader(r), crc)
+
+	var buf [bucketPacketSize]byte
+	if _, err := io.ReadFull(tr, buf[:16]); err != nil {
+		return nil, fmt.Errorf("snapshot header: %v", err)
+	}
+
+	if !bytes.Equal(buf[:4], snapshotMagic[:]) {
+		return nil, errors.New("not a snapshot")
+	}
+
+	if v := binary.BigEndian.Uint32(buf[4:]); v != snapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d isn't supported, want %d", v, snapshotVersion)
+	}
+
+	// Buckets are decoded only once the checksum is verified.
+	count := binary.BigEndian.Uint64(buf[8:])
+	var records []snapshotRecord
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(tr, buf[:10]); err != nil {
+			return nil, fmt.Errorf("snapshot bucket %d: %v", i, err)
+		}
+
+		var r snapshotRecord
+		if ns := int64(binary.BigEndian.Uint64(buf[:])); ns != 0 {
+			r.created = time.Unix(0, ns)
+		}
+
+		size := int(binary.BigEndian.Uint16(buf[8:]))
+		if size > len(buf) {
+			return nil, fmt.Errorf("snapshot bucket %d: size %d is too large", i, size)
+		}
+
+		r.data = make([]byte, size)
+		if _, err := io.ReadFull(tr, r.data); err != nil {
+			return nil, fmt.Errorf("snapshot bucket %d: %v", i, err)
+		}
+
+		records = append(records, r)
+	}
+
+	sum := crc.Sum32()
+	if _, err := io.ReadFull(tr, buf[:4]); err != nil {
+		return nil, fmt.Errorf("snapshot checksum: %v", err)
+	} else if binary.BigEndian.Uint32(buf[:]) != sum {
+		return nil, ErrSnapshotChecksum
+	}
+
+	bs := make([]*Bucket, len(records))
+	for i, r := range records {
+		bs[i] = &Bucket{created: r.created}
+		if err := bs[i].UnmarshalBinary(r.data); err != nil {
+			return nil, fmt.Errorf("snapshot bucket %d: %v", i, err)
+		}
+	}
+
+	return bs, nil
+}
+
+// SaveSnapshot atomically replaces the given file with a snapshot of the given Buckets.
+func SaveSnapshot(filename string, bs []*Bucket) (err error) {
+	f, err := createTemp(filename)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err = WriteSnapshot(f, bs); err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return renameSync(f.Name(), filename)
+}
+
+// createTemp creates a temporary file in the directory of the given file, with its
+// permissions or 0644 if it doesn't exist, which then replaces it with renameSync.
+func createTemp(filename string) (*os.File, error) {
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		perm = fi.Mode().Perm()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	// TempFile creates files only readable by their owner.
+	if err = f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// renameSync renames oldpath to newpath and fsyncs the directory of newpath,
+// so that the rename survives crashes.
+func renameSync(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(newpath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// LoadSnapshot reads the Buckets of the snapshot in the given file.
+func LoadSnapshot(filename string) ([]*Bucket, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadSnapshot(f)
+}
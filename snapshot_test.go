@@ -0,0 +1,149 @@
+package patrol
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	bs := []*Bucket{
+		{name: "token", created: created, added: 10, taken: 5, elapsed: time.Second},
+		{name: "gcra", created: created.Add(time.Hour), algo: GCRA, tat: created.UnixNano()},
+		{name: "window", algo: SlidingWindow, window: 42, curr: 3, prev: 7},
+		{name: "zero", created: created}, // Skipped
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, bs); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadSnapshot(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("have %d buckets, want 3", len(got))
+	}
+
+	for i, b := range got {
+		want := bs[i]
+		if !b.created.Equal(want.created) {
+			t.Errorf("%s: have created %v, want %v", want.name, b.created, want.created)
+		}
+
+		have, _ := b.MarshalBinary()
+		data, _ := want.MarshalBinary()
+		if !bytes.Equal(have, data) {
+			t.Errorf("%s: have state %v, want %v", want.name, b, want)
+		}
+	}
+}
+
+func TestSnapshot_Errors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, []*Bucket{{name: "foo", added: 1, taken: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	for _, tc := range []struct {
+		name string
+		data func([]byte) []byte
+		err  string
+	}{
+		{
+			name: "empty",
+			data: func([]byte) []byte { return nil },
+			err:  "snapshot header: EOF",
+		},
+		{
+			name: "magic",
+			data: func(b []byte) []byte { b[0] = 'X'; return b },
+			err:  "not a snapshot",
+		},
+		{
+			name: "version",
+			data: func(b []byte) []byte { b[7] = 2; return b },
+			err:  "snapshot version 2 isn't supported, want 1",
+		},
+		{
+			name: "truncated",
+			data: func(b []byte) []byte { return b[:len(b)-10] },
+			err:  "snapshot bucket 0: unexpected EOF",
+		},
+		{
+			name: "corrupted",
+			data: func(b []byte) []byte { b[len(b)-8] ^= 0xff; return b },
+			err:  ErrSnapshotChecksum.Error(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.data(append([]byte(nil), snapshot...))
+			bs, err := ReadSnapshot(bytes.NewReader(data))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("have error %v, want %q", err, tc.err)
+			}
+			if bs != nil {
+				t.Errorf("have buckets %v, want none", bs)
+			}
+		})
+	}
+}
+
+func TestSaveSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patrol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "snapshot")
+	for _, taken := range []float64{1, 2} { // Replaces the previous snapshot.
+		if err = SaveSnapshot(filename, []*Bucket{{name: "foo", taken: taken}}); err != nil {
+			t.Fatal(err)
+		}
+
+		if taken == 1 {
+			if err = os.Chmod(filename, 0640); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if fi, err := os.Stat(filename); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("have file %v (%v), want the permissions of the replaced snapshot", fi, err)
+	}
+
+	bs, err := LoadSnapshot(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bs) != 1 || bs[0].name != "foo" || bs[0].taken != 2 {
+		t.Fatalf("have buckets %v, want foo with 2 taken", bs)
+	}
+
+	// Restored Buckets don't know their Rate until taken from again, so they expire
+	// once they weren't touched for a TTL since their restore.
+	now, ttl := time.Now().Add(time.Hour), time.Minute
+	restored, _ := NewLocalRepo(func() time.Time { return now }).UpsertBucket(context.Background(), bs[0])
+	if restored.Expired(now.Add(ttl/2), ttl) {
+		t.Errorf("have restored %v expired, want it kept for %s", restored, ttl)
+	}
+	if !restored.Expired(now.Add(ttl), ttl) {
+		t.Errorf("have restored %v kept, want it expired after %s", restored, ttl)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("have %d files, want only the snapshot", len(files))
+	}
+}
@@ -0,0 +1,134 @@
+package patrol
+
+import (
+	"math"
+	"time"
+)
+
+// Window based Buckets count the tokens taken in the current and previous windows of
+// the Rate's period, which are numbered since the Unix epoch. Unlike the elapsed time of
+// token Buckets, window numbers are absolute, so nodes must have loosely synchronized clocks
+// for windows to line up across the cluster.
+//
+// Their state is a map of window numbers to tokens taken, truncated to the two latest
+// windows, and merged by taking the maximum of each window's count, which makes it a
+// state based CRDT.
+
+// windowAt returns the number of the window of the given Rate that contains time now,
+// and how far into that window now is, as a fraction.
+func windowAt(now time.Time, r Rate) (window int64, progress float64) {
+	ns, per := now.UnixNano(), int64(r.Per)
+	return ns / per, float64(ns%per) / float64(per)
+}
+
+// windows returns the tokens taken in the current and previous windows at time now,
+// and how far into the current window now is. It must be called with the lock held.
+func (b *Bucket) windows(now time.Time, r Rate) (curr, prev, progress float64) {
+	window, progress := windowAt(now, r)
+	switch {
+	case window < b.window: // Our clock is behind the cluster's.
+		return b.curr, b.prev, 0
+	case window == b.window:
+		return b.curr, b.prev, progress
+	case window == b.window+1:
+		return 0, b.curr, progress
+	default:
+		return 0, 0, progress
+	}
+}
+
+// windowUsed returns the tokens counted against the capacity at time now.
+// It must be called with the lock held.
+func (b *Bucket) windowUsed(now time.Time, r Rate) float64 {
+	curr, prev, progress := b.windows(now, r)
+	if b.algo == SlidingWindow {
+		return curr + prev*(1-progress)
+	}
+	return curr
+}
+
+// windowAvailable returns the tokens that can be taken at time now.
+// It must be called with the lock held.
+func (b *Bucket) windowAvailable(now time.Time, r Rate) float64 {
+	if r.IsZero() {
+		return 0
+	}
+	return math.Max(0, r.capacity()-b.windowUsed(now, r))
+}
+
+// windowTake implements Take for window based Buckets. It must be called with the
+// write lock held.
+func (b *Bucket) windowTake(now time.Time, r Rate, n uint64) (remaining uint64, ok bool) {
+	if r.IsZero() {
+		return 0, false
+	}
+
+	have := b.windowAvailable(now, r)
+
+	taken := float64(n)
+	if taken > have {
+		return uint64(have), false
+	}
+
+	if window, _ := windowAt(now, r); window > b.window {
+		b.curr, b.prev, _ = b.windows(now, r)
+		b.window = window
+	}
+	b.curr += taken
+
+	return uint64(have - taken), true
+}
+
+// windowDelay implements Delay for window based Buckets. It must be called with the
+// read lock held.
+func (b *Bucket) windowDelay(now time.Time, r Rate, n uint64) (time.Duration, bool) {
+	if float64(n) <= b.windowAvailable(now, r) {
+		return 0, true
+	} else if float64(n) > r.capacity() || r.IsZero() {
+		return 0, false
+	}
+
+	// The tokens counted against the capacity must go down to target.
+	target := r.capacity() - float64(n)
+	curr, prev, progress := b.windows(now, r)
+
+	var wait float64 // In fractions of a window.
+	switch {
+	case b.algo == FixedWindow:
+		wait = 1 - progress
+	case curr <= target: // Enough of the previous window slides out in the current one.
+		wait = 1 - (target-curr)/prev - progress
+	default: // Enough of the current window slides out in the next one.
+		wait = 1 - progress + 1 - target/curr
+	}
+
+	return time.Duration(math.Ceil(wait * float64(r.Per))), true
+}
+
+// windowExpired returns true if no tokens are counted against the capacity at time now
+// and the last window ended more than ttl before it. It must be called with the read
+// lock held.
+func (b *Bucket) windowExpired(now time.Time, ttl time.Duration) bool {
+	if b.rate.IsZero() { // Only merged from peers, so the window size is unknown.
+		return b.untouched(now, ttl)
+	}
+
+	end := time.Unix(0, (b.window+1)*int64(b.rate.Per))
+	return now.Sub(end) >= ttl && b.windowUsed(now, b.rate) == 0
+}
+
+// mergeWindows merges the window counts of the other Bucket into b.
+// It must be called with b's write lock and other's read lock held.
+func (b *Bucket) mergeWindows(other *Bucket) {
+	switch {
+	case other.window == b.window:
+		b.curr = math.Max(b.curr, other.curr)
+		b.prev = math.Max(b.prev, other.prev)
+	case other.window == b.window+1:
+		b.window, b.curr, b.prev = other.window, other.curr, math.Max(other.prev, b.curr)
+	case other.window > b.window:
+		b.window, b.curr, b.prev = other.window, other.curr, other.prev
+	case other.window == b.window-1:
+		b.prev = math.Max(b.prev, other.curr)
+	}
+}
@@ -0,0 +1,229 @@
+package patrol
+
+import (
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestBucket_WindowMarshaling(t *testing.T) {
+	prop := func(name string, algo uint8, window int64, curr, prev float64, generation uint32) bool {
+		b := Bucket{
+			name:       name,
+			algo:       SlidingWindow + Algorithm(algo%2),
+			window:     window,
+			curr:       curr,
+			prev:       prev,
+			generation: generation,
+		}
+		data, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Nodes which only know the TokenBucket layout fail to read it.
+		if nameLen := int(data[24]); nameLen <= len(data[25:]) {
+			return false
+		}
+
+		decoded := Bucket{added: 1, taken: 1}
+		if err = decoded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+
+		return b == decoded
+	}
+
+	if err := quick.Check(prop, &quick.Config{MaxCount: 1e5}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, bucketAlgoFixedSize)
+	data[24], data[25], data[26] = bucketAlgoMarker, bucketAlgoVersion, byte(len(algorithmNames))
+	if err := new(Bucket).UnmarshalBinary(data); err == nil {
+		t.Error("want error unmarshaling unknown algorithm")
+	}
+
+	data[25], data[26] = bucketAlgoVersion+1, byte(SlidingWindow)
+	if err := new(Bucket).UnmarshalBinary(data); err == nil {
+		t.Error("want error unmarshaling unknown version")
+	}
+}
+
+func TestBucket_WindowExpired(t *testing.T) {
+	now := time.Now()
+	rate := Rate{Freq: 10, Per: time.Second}
+	ttl := time.Minute
+
+	taken := &Bucket{name: "taken", created: now, algo: SlidingWindow}
+	taken.Take(now, rate, 10)
+
+	merged := &Bucket{name: "merged", created: now}
+	merged.Merge(taken)
+
+	later := now.Add(ttl + 2*rate.Per)
+	if !taken.Expired(later, ttl) {
+		t.Error("want Bucket to expire a TTL after its windows emptied")
+	}
+
+	if merged.Expired(now.Add(ttl/2), ttl) {
+		t.Error("want Bucket merged from peers, of unknown window size, to not expire while touched")
+	}
+
+	if !merged.Expired(later, ttl) {
+		t.Error("want Bucket merged from peers, of unknown window size, to expire a TTL after its creation")
+	}
+}
+
+func TestBucket_TakeWindowZeroRate(t *testing.T) {
+	now := time.Now()
+	for _, algo := range []Algorithm{SlidingWindow, FixedWindow} {
+		b := &Bucket{name: "foo", created: now, algo: algo}
+		if rem, ok := b.Take(now, Rate{}, 0); rem != 0 || ok {
+			t.Errorf("%s: have %d, %t, want 0, false", algo, rem, ok)
+		}
+	}
+}
+
+func TestBucket_TakeWindow(t *testing.T) {
+	type step struct {
+		elapsed time.Duration
+		take    uint64
+		ok      bool
+		rem     uint64
+	}
+
+	rate := Rate{Freq: 10, Per: time.Second}
+	for _, tc := range []struct {
+		algo  Algorithm
+		steps []step
+	}{
+		{
+			algo: SlidingWindow,
+			steps: []step{
+				{elapsed: 0, take: 6, ok: true, rem: 4},
+				{elapsed: 500 * time.Millisecond, take: 5, ok: false, rem: 4},
+				{elapsed: 500 * time.Millisecond, take: 4, ok: true, rem: 0}, // 6 of the previous window still count.
+				{elapsed: 500 * time.Millisecond, take: 3, ok: true, rem: 0}, // Half of the previous window slid out.
+				{elapsed: time.Second, take: 1, ok: true, rem: 5},            // 3.5 of the previous window count.
+				{elapsed: 2 * time.Second, take: 0, ok: true, rem: 10},       // Both windows slid out.
+				{elapsed: time.Millisecond, take: 11, ok: false, rem: 10},    // More than the capacity.
+			},
+		},
+		{
+			algo: FixedWindow,
+			steps: []step{
+				{elapsed: 900 * time.Millisecond, take: 10, ok: true, rem: 0},
+				{elapsed: 50 * time.Millisecond, take: 1, ok: false, rem: 0},
+				{elapsed: 50 * time.Millisecond, take: 10, ok: true, rem: 0}, // The next window starts over.
+				{elapsed: 500 * time.Millisecond, take: 1, ok: false, rem: 0},
+			},
+		},
+	} {
+		t.Run(tc.algo.String(), func(t *testing.T) {
+			bucket := Bucket{algo: tc.algo}
+			now := time.Unix(1000, 0)
+			for i, s := range tc.steps {
+				now = now.Add(s.elapsed)
+				rem, ok := bucket.Take(now, rate, s.take)
+				if ok != s.ok || rem != s.rem {
+					t.Errorf("step %d: have (%t, %d), want (%t, %d)", i, ok, rem, s.ok, s.rem)
+				}
+			}
+		})
+	}
+}
+
+func TestBucket_DelayWindow(t *testing.T) {
+	rate := Rate{Freq: 10, Per: time.Second}
+	now := time.Unix(1000, 0)
+
+	for _, tc := range []struct {
+		algo    Algorithm
+		elapsed time.Duration
+		n       uint64
+		delay   time.Duration
+		ok      bool
+	}{
+		{algo: SlidingWindow, n: 1, delay: 1100 * time.Millisecond, ok: true},
+		{algo: SlidingWindow, elapsed: time.Second, n: 5, delay: 500 * time.Millisecond, ok: true},
+		{algo: SlidingWindow, n: 11, ok: false},
+		{algo: FixedWindow, elapsed: 300 * time.Millisecond, n: 1, delay: 700 * time.Millisecond, ok: true},
+		{algo: FixedWindow, elapsed: time.Second, n: 10, delay: 0, ok: true},
+	} {
+		bucket := Bucket{algo: tc.algo}
+		bucket.Take(now, rate, 10)
+
+		delay, ok := bucket.Delay(now.Add(tc.elapsed), rate, tc.n)
+		if delay != tc.delay || ok != tc.ok {
+			t.Errorf("%s: Delay(+%s, %d): have (%s, %t), want (%s, %t)",
+				tc.algo, tc.elapsed, tc.n, delay, ok, tc.delay, tc.ok)
+		}
+
+		// The Bucket must allow the take once the delay has passed.
+		if _, taken := bucket.Take(now.Add(tc.elapsed+delay), rate, tc.n); ok && !taken {
+			t.Errorf("%s: Take(+%s, %d) failed after the delay", tc.algo, tc.elapsed+delay, tc.n)
+		}
+	}
+}
+
+func TestBucket_Use(t *testing.T) {
+	var b Bucket
+	if err := b.Use(SlidingWindow); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Take(time.Unix(1000, 0), Rate{Freq: 1, Per: time.Second}, 1)
+	if err := b.Use(SlidingWindow); err != nil {
+		t.Errorf("Use of the same Algorithm: %v", err)
+	}
+
+	if err := b.Use(TokenBucket); err == nil {
+		t.Error("want error changing the Algorithm of a used Bucket")
+	}
+}
+
+func TestBucket_MergeWindows(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	buckets := make([]*Bucket, 100)
+	for i := range buckets {
+		buckets[i] = &Bucket{
+			algo:   SlidingWindow,
+			window: 100 + rng.Int63n(5),
+			curr:   rng.Float64(),
+			prev:   rng.Float64(),
+		}
+	}
+
+	var sequential Bucket
+	for _, bucket := range buckets {
+		sequential.Merge(&sequential, bucket)
+	}
+
+	// Like with token Buckets, merging in any order must converge.
+	for i := 0; i < 10000; i++ {
+		rng.Shuffle(len(buckets), func(i, j int) {
+			buckets[i], buckets[j] = buckets[j], buckets[i]
+		})
+
+		var random Bucket
+		for _, bucket := range buckets {
+			random.Merge(bucket, bucket)
+		}
+
+		if random != sequential {
+			t.Fatalf(
+				"Buckets merged in random order diverged from sequential result:\nhave: %v\nwant: %v",
+				&random,
+				&sequential,
+			)
+		}
+	}
+
+	a := Bucket{algo: SlidingWindow, window: 5, curr: 3, prev: 1}
+	b := Bucket{algo: SlidingWindow, window: 6, curr: 1}
+	if a.Merge(&b); a.window != 6 || a.curr != 1 || a.prev != 3 {
+		t.Errorf("have window %d, curr %f, prev %f; want window 6, curr 1, prev 3", a.window, a.curr, a.prev)
+	}
+}